@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"deploybot-service-agent/model"
+	"deploybot-service-agent/util"
+)
+
+const registerRetryBase = time.Second
+
+// agentInfo collects what the agent reports about itself and its host. The
+// parts that fail to be collected, e.g. while Docker is down, are left out.
+func (s *Scheduler) agentInfo(ctx context.Context) model.AgentInfo {
+	tasks := s.queue.Tasks()
+	queued := s.queue.Len()
+
+	info := model.AgentInfo{
+		AgentId:      s.cfg.AgentId,
+		Mode:         s.cfg.AgentMode,
+		Version:      s.cfg.Version,
+		StartedAt:    s.started,
+		QueuedTasks:  queued,
+		RunningTasks: len(tasks) - queued,
+		Disks:        []model.DiskInfo{},
+		Containers:   []model.ContainerInfo{},
+		Networks:     []model.Network{},
+	}
+
+	if v, err := s.cHelper.GetServerVersion(ctx); err != nil {
+		log.Println("Error getting the Docker version:", err)
+	} else {
+		info.DockerVersion = v
+	}
+
+	for _, path := range s.cfg.HeartbeatDiskPaths {
+		if d, err := util.GetDiskInfo(path); err == nil {
+			info.Disks = append(info.Disks, *d)
+		}
+	}
+
+	if containers, err := s.cHelper.GetContainers(ctx); err != nil {
+		log.Println("Error listing containers:", err)
+	} else {
+		for _, c := range containers {
+			var name string
+			if len(c.Names) > 0 {
+				name = strings.TrimPrefix(c.Names[0], "/")
+			}
+			info.Containers = append(info.Containers, model.ContainerInfo{Id: c.ID, Name: name, Image: c.Image, State: c.State, Status: c.Status})
+		}
+	}
+
+	if networks, err := s.cHelper.GetNetworks(ctx); err != nil {
+		log.Println("Error listing networks:", err)
+	} else if networks != nil {
+		info.Networks = networks
+	}
+
+	return info
+}
+
+// RunHeartbeat registers the agent with the control plane, then sends a
+// heartbeat every HeartbeatInterval until ctx is done. Registration is retried
+// with backoff, and done again when the control plane no longer knows the
+// agent.
+func (s *Scheduler) RunHeartbeat(ctx context.Context) {
+	registered, attempt := false, 0
+
+	for {
+		path := "/agent/heartbeat"
+		if !registered {
+			path = "/agent/register"
+		}
+
+		err := s.api.Do(ctx, "POST", path, s.agentInfo(ctx), nil)
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := s.cfg.HeartbeatInterval
+
+		var apiErr *ApiError
+		switch {
+		case err == nil:
+			if !registered {
+				log.Printf("Registered agent %s with %s", s.cfg.AgentId, s.cfg.ApiBaseUrl)
+			}
+			registered, attempt = true, 0
+		case registered && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+			log.Printf("Agent %s unknown to the control plane, registering again", s.cfg.AgentId)
+			registered, delay = false, 0
+		case !registered:
+			delay = backoff(attempt, registerRetryBase, s.cfg.HeartbeatInterval)
+			attempt++
+			log.Printf("Error registering agent, retrying in %s: %v", delay.Round(time.Second), err)
+		default:
+			log.Println("Error sending heartbeat:", err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// GoOffline tells the control plane that the agent is shutting down.
+func (s *Scheduler) GoOffline(ctx context.Context) error {
+	return s.api.Do(ctx, "POST", "/agent/offline", model.AgentOfflineInput{AgentId: s.cfg.AgentId}, nil)
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"deploybot-service-agent/model"
+	"deploybot-service-agent/util"
+)
+
+func TestRunHeartbeat(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	var last model.AgentInfo
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		paths = append(paths, r.URL.Path)
+		json.NewDecoder(r.Body).Decode(&last)
+
+		// The control plane forgets the agent after its first heartbeat.
+		if len(paths) == 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+
+	queue, _, err := NewTaskQueue(filepath.Join(t.TempDir(), "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scheduler{
+		// Docker is unreachable, so only the agent itself is reported.
+		cHelper: util.NewContainerHelper("tcp://127.0.0.1:1", util.DhCredentials{}, nil, nil),
+		cfg:     SchedulerConfig{ApiBaseUrl: srv.URL, AgentId: "agent-1", AgentMode: AgentModeWebhook, Version: "1.2.3", HeartbeatInterval: 10 * time.Millisecond, HeartbeatDiskPaths: []string{"/"}},
+		queue:   queue,
+		api:     NewControlPlaneClient(srv.URL, "key", time.Second, 0),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.RunHeartbeat(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(paths)
+		mu.Unlock()
+
+		if n >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d requests", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{"/agent/register", "/agent/heartbeat", "/agent/register", "/agent/heartbeat"}
+	for i, p := range want {
+		if paths[i] != p {
+			t.Fatalf("request %d: got %s, want %s", i, paths[i], p)
+		}
+	}
+
+	if last.AgentId != "agent-1" || last.Version != "1.2.3" || len(last.Disks) != 1 {
+		t.Fatalf("unexpected agent info %+v", last)
+	}
+}
@@ -5,9 +5,13 @@ import (
 	types "deploybot-service-agent/deploybot-types"
 	"deploybot-service-agent/model"
 	"deploybot-service-agent/util"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"strings"
 
+	dTypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/gin-gonic/gin"
 )
@@ -20,6 +24,10 @@ func (s *Scheduler) GetServiceLog() gin.HandlerFunc {
 			return
 		}
 
+		if !authorizeService(ctx, name) {
+			return
+		}
+
 		ShowStdout := ctx.Query("showStdout") == "true"
 		ShowStderr := ctx.Query("showStderr") == "true"
 		Follow := ctx.Query("follow") == "true"
@@ -103,10 +111,11 @@ func (s *Scheduler) DeleteBuilderCache() gin.HandlerFunc {
 func (s *Scheduler) CreateNetwork() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var input model.CreateNetworkInput
-		err := ctx.BindJSON(&input)
+		err := ctx.ShouldBindJSON(&input)
 
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, model.CreateNetworkResponse{Msg: err.Error(), Code: types.CodeServerError})
+			ctx.JSON(http.StatusBadRequest, model.CreateNetworkResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
 		}
 
 		name := input.Name
@@ -168,24 +177,42 @@ func (s *Scheduler) CreateService() gin.HandlerFunc {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		err := s.cHelper.StartContainer(&deployConfig)
+
+		if !authorizeService(ctx, deployConfig.ServiceName) {
+			return
+		}
+
+		defer s.lockService(deployConfig.ServiceName)()
+
+		err := s.deploy(ctx.Request.Context(), &deployConfig, os.Stdout)
+		if errors.Is(err, util.ErrPathNotAllowed) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		ctx.JSON(http.StatusOK, gin.H{"status": "deployment started"})
+		ctx.JSON(http.StatusOK, gin.H{"status": "deployed"})
 	}
 }
 
 func (s *Scheduler) UpdateService() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var input model.UpdateServiceInput
-		err := ctx.BindJSON(&input)
+		err := ctx.ShouldBindJSON(&input)
 
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, model.ApiResponse{Msg: err.Error(), Code: types.CodeServerError})
+			ctx.JSON(http.StatusBadRequest, model.ApiResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		if !authorizeService(ctx, input.Name) {
+			return
 		}
 
+		defer s.lockService(input.Name)()
+
 		if input.Restarting {
 			err = s.cHelper.RestartContainer(ctx, input.Name)
 		} else if !input.Running {
@@ -205,6 +232,12 @@ func (s *Scheduler) DeleteService() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		name := ctx.Param("name")
 
+		if !authorizeService(ctx, name) {
+			return
+		}
+
+		defer s.lockService(name)()
+
 		err := s.cHelper.RemoveContainer(ctx, name)
 
 		if err != nil {
@@ -219,35 +252,143 @@ func (s *Scheduler) GetService() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		name := ctx.Param("name")
 
+		if !authorizeService(ctx, name) {
+			return
+		}
+
+		reveal, ok := revealSecrets(ctx)
+		if !ok {
+			return
+		}
+
 		res, err := s.cHelper.GetContainer(ctx, name)
 
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, model.ApiResponse{Msg: err.Error(), Code: types.CodeServerError})
 			return
 		}
+
+		if !reveal {
+			s.redactor.ContainerJSON(&res)
+		}
+
 		ctx.JSON(http.StatusOK, model.ApiResponse{Payload: res})
 	}
 }
 
 func (s *Scheduler) GetServices() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		reveal, ok := revealSecrets(ctx)
+		if !ok {
+			return
+		}
+
 		res, err := s.cHelper.GetContainers(ctx)
 
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, model.ApiResponse{Msg: err.Error(), Code: types.CodeServerError})
 			return
 		}
+
+		if p := PrincipalFrom(ctx); p != nil && len(p.Services) > 0 {
+			res = filterContainers(res, p)
+		}
+
+		if !reveal {
+			for i := range res {
+				s.redactor.Container(&res[i])
+			}
+		}
+
 		ctx.JSON(http.StatusOK, model.ApiResponse{Payload: res})
 	}
 
 }
 
+func (s *Scheduler) GetSecrets() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, model.ApiResponse{Payload: s.secrets.List()})
+	}
+}
+
+func (s *Scheduler) SetSecret() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input model.SetSecretInput
+		err := ctx.ShouldBindJSON(&input)
+
+		if err == nil {
+			err = s.secrets.Set(ctx.Param("name"), input.Value)
+		}
+
+		if errors.Is(err, util.ErrInvalidSecretName) {
+			ctx.JSON(http.StatusBadRequest, model.ApiResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, model.ApiResponse{Msg: err.Error(), Code: types.CodeServerError})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, model.ApiResponse{})
+	}
+}
+
+func (s *Scheduler) DeleteSecret() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := s.secrets.Delete(ctx.Param("name"))
+
+		if errors.Is(err, util.ErrSecretNotFound) {
+			ctx.JSON(http.StatusNotFound, model.ApiResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, model.ApiResponse{Msg: err.Error(), Code: types.CodeServerError})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, model.ApiResponse{})
+	}
+}
+
 func (s *Scheduler) HealthCheckHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 
 	}
 }
 
+// revealSecrets reports whether the caller asked for unredacted output with
+// reveal=true. Only admins may do so; other callers get a 403 and ok is false.
+func revealSecrets(ctx *gin.Context) (reveal bool, ok bool) {
+	if ctx.Query("reveal") != "true" {
+		return false, true
+	}
+
+	if p := PrincipalFrom(ctx); p != nil && !p.Role.Includes(RoleAdmin) {
+		abortForbidden(ctx, fmt.Errorf("%w: admin role required to reveal secrets", ErrPermissionDenied))
+		return false, false
+	}
+
+	return true, true
+}
+
+// filterContainers keeps the containers with at least one name the principal
+// may access.
+func filterContainers(containers []dTypes.Container, p *Principal) []dTypes.Container {
+	var res []dTypes.Container
+	for _, c := range containers {
+		for _, n := range c.Names {
+			if p.CanAccessService(strings.TrimPrefix(n, "/")) {
+				res = append(res, c)
+				break
+			}
+		}
+	}
+
+	return res
+}
+
 func resolveParam(c *gin.Context, param string) string {
 	// preferred: path parameter
 	value := c.Param(param)
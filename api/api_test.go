@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"deploybot-service-agent/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetServiceRedaction(t *testing.T) {
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" {
+			w.Header().Set("Api-Version", "1.45")
+			return
+		}
+
+		w.Write([]byte(`{"Id": "abc", "Name": "/web", "Config": {"Env": ["DB_PASSWORD=hunter2", "PORT=80"], "Labels": {"api_token": "t0k3n", "team": "web"}}}`))
+	}))
+	defer docker.Close()
+
+	redactor, err := util.NewRedactor(util.DefaultRedactPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scheduler{
+		cHelper:  util.NewContainerHelper("tcp://"+strings.TrimPrefix(docker.URL, "http://"), util.DhCredentials{}, nil, nil),
+		redactor: redactor,
+	}
+
+	g := gin.New()
+	g.GET("/service/:name", func(ctx *gin.Context) {
+		ctx.Set(principalKey, &Principal{Role: Role(ctx.GetHeader("X-Role"))})
+	}, s.GetService())
+
+	get := func(role Role, query string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/service/web"+query, nil)
+		req.Header.Set("X-Role", string(role))
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	for _, c := range []struct {
+		role   Role
+		query  string
+		code   int
+		reveal bool
+	}{
+		{RoleRead, "", http.StatusOK, false},
+		{RoleAdmin, "", http.StatusOK, false},
+		{RoleOperator, "?reveal=true", http.StatusForbidden, false},
+		{RoleAdmin, "?reveal=true", http.StatusOK, true},
+	} {
+		code, body := get(c.role, c.query)
+		if code != c.code {
+			t.Errorf("%s%s: got %d, want %d", c.role, c.query, code, c.code)
+			continue
+		}
+
+		secret := strings.Contains(body, "hunter2") || strings.Contains(body, "t0k3n")
+		if secret != c.reveal {
+			t.Errorf("%s%s: secrets revealed %v, want %v: %s", c.role, c.query, secret, c.reveal, body)
+		}
+		if code == http.StatusOK && !strings.Contains(body, "PORT=80") {
+			t.Errorf("%s%s: plain variable masked: %s", c.role, c.query, body)
+		}
+	}
+
+	// The masked values keep their keys.
+	_, body := get(RoleRead, "")
+
+	var res struct {
+		Payload struct {
+			Config struct {
+				Env []string
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if env := res.Payload.Config.Env; len(env) != 2 || env[0] != "DB_PASSWORD="+util.RedactedValue {
+		t.Errorf("env = %v", env)
+	}
+}
+
+func TestMalformedBody(t *testing.T) {
+	var requests []string
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" {
+			w.Header().Set("Api-Version", "1.45")
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	}))
+	defer docker.Close()
+
+	s := &Scheduler{cHelper: util.NewContainerHelper("tcp://"+strings.TrimPrefix(docker.URL, "http://"), util.DhCredentials{}, nil, nil)}
+
+	g := gin.New()
+	g.PUT("/service", s.UpdateService())
+	g.POST("/network", s.CreateNetwork())
+
+	// A body that does not decode is refused before Docker is called.
+	for _, route := range []string{"PUT /service", "POST /network"} {
+		method, path, _ := strings.Cut(route, " ")
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(`{"name":`)))
+		if w.Code != http.StatusBadRequest || strings.Count(w.Body.String(), "{") != 1 {
+			t.Errorf("%s: got %d %s, want a single 400", route, w.Code, w.Body)
+		}
+	}
+
+	if len(requests) != 0 {
+		t.Fatalf("Docker called with a malformed body: %v", requests)
+	}
+}
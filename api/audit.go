@@ -0,0 +1,373 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+	"deploybot-service-agent/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditFileName = "audit.log"
+
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+
+	// Request and response bodies larger than this are not summarized.
+	auditBodyLimit  = 64 << 10
+	auditErrorLimit = 1 << 10
+)
+
+// Routes whose request bodies are never recorded.
+var auditSecretRoutes = map[string]bool{
+	"/secret/:name": true,
+}
+
+type AuditEntry struct {
+	Time       time.Time   `json:"time"`
+	Actor      string      `json:"actor"`
+	AuthMethod string      `json:"authMethod,omitempty"`
+	Client     string      `json:"client,omitempty"`
+	RemoteAddr string      `json:"remoteAddr,omitempty"`
+	Action     string      `json:"action"`
+	Target     string      `json:"target,omitempty"`
+	Request    interface{} `json:"request,omitempty"`
+	Result     string      `json:"result"`
+	Status     int         `json:"status,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	DurationMs int64       `json:"durationMs"`
+}
+
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+	Actor string
+	Limit int
+}
+
+func (f AuditFilter) match(e *AuditEntry) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.Actor == "" || e.Actor == f.Actor)
+}
+
+// AuditLog is an append-only JSON lines file that is rotated to audit.log.1,
+// audit.log.2, ... once it exceeds maxSize bytes, keeping at most maxFiles
+// rotated files.
+type AuditLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditLog(dir string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	l := &AuditLog{dir: dir, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *AuditLog) path(n int) string {
+	if n == 0 {
+		return filepath.Join(l.dir, auditFileName)
+	}
+	return filepath.Join(l.dir, auditFileName+"."+strconv.Itoa(n))
+}
+
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.path(0), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+func (l *AuditLog) rotate() error {
+	l.file.Close()
+
+	os.Remove(l.path(l.maxFiles))
+	for n := l.maxFiles - 1; n >= 0; n-- {
+		os.Rename(l.path(n), l.path(n+1))
+	}
+
+	return l.open()
+}
+
+func (l *AuditLog) Record(e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+
+	return err
+}
+
+// Query returns the entries matching f, oldest first. When f.Limit is set only
+// the newest f.Limit matches are returned.
+func (l *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var res []AuditEntry
+	for n := l.maxFiles; n >= 0; n-- {
+		file, err := os.Open(l.path(n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var e AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && f.match(&e) {
+				res = append(res, e)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f.Limit > 0 && len(res) > f.Limit {
+		res = res[len(res)-f.Limit:]
+	}
+
+	return res, nil
+}
+
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if room := auditErrorLimit - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(room, len(b))])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// AuditMiddleware records every mutating request, including the ones rejected
+// by authentication, with the caller, the targeted resource and a redacted
+// summary of the request body. It must run before the authentication
+// middleware so that rejected requests are recorded too.
+func (s *Scheduler) AuditMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.Method == http.MethodGet || ctx.Request.Method == http.MethodOptions {
+			ctx.Next()
+			return
+		}
+
+		start := time.Now()
+
+		var summary interface{}
+		if ctx.Request.ContentLength <= auditBodyLimit && !auditSecretRoutes[ctx.FullPath()] {
+			body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, auditBodyLimit))
+			if err == nil {
+				summary = summarizeRequest(s.redactor, body)
+				ctx.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), ctx.Request.Body))
+			}
+		}
+
+		w := &auditResponseWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = w
+
+		ctx.Next()
+
+		e := AuditEntry{
+			Time:       start,
+			RemoteAddr: ctx.ClientIP(),
+			Action:     ctx.Request.Method + " " + ctx.FullPath(),
+			Target:     auditTarget(ctx, summary),
+			Request:    summary,
+			Status:     w.Status(),
+			DurationMs: time.Since(start).Milliseconds(),
+			Result:     AuditResultSuccess,
+		}
+
+		setAuditActor(&e, PrincipalFrom(ctx))
+
+		if e.Status >= http.StatusBadRequest {
+			e.Result = AuditResultFailure
+			e.Error = responseError(w.body.Bytes())
+		}
+
+		if err := s.audit.Record(e); err != nil {
+			fmt.Println("Error writing audit log:", err)
+		}
+	}
+}
+
+func (s *Scheduler) GetAuditLog() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var f AuditFilter
+		var err error
+
+		if v := ctx.Query("since"); v != "" {
+			f.Since, err = time.Parse(time.RFC3339, v)
+		}
+		if v := ctx.Query("until"); v != "" && err == nil {
+			f.Until, err = time.Parse(time.RFC3339, v)
+		}
+		if v := ctx.DefaultQuery("limit", "1000"); err == nil {
+			f.Limit, err = strconv.Atoi(v)
+		}
+		f.Actor = ctx.Query("actor")
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, model.ApiResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		entries, err := s.audit.Query(f)
+
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, model.ApiResponse{Msg: err.Error(), Code: types.CodeServerError})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, model.ApiResponse{Payload: entries})
+	}
+}
+
+func setAuditActor(e *AuditEntry, p *Principal) {
+	if p == nil {
+		e.Actor = "anonymous"
+		return
+	}
+
+	e.Actor, e.AuthMethod = p.Subject, p.Method
+	if p.Certificate != nil {
+		e.Client = p.Certificate.CommonName
+	}
+}
+
+// summarizeRequest decodes a JSON body with secrets redacted and file contents
+// replaced by their size.
+func summarizeRequest(r *util.Redactor, body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+
+	return summarizeConfig(r, v)
+}
+
+func summarizeConfig(r *util.Redactor, v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok {
+		if files, ok := m["files"].(map[string]interface{}); ok {
+			sizes := make(map[string]interface{}, len(files))
+			for name, content := range files {
+				c, _ := content.(string)
+				sizes[name] = fmt.Sprintf("<%d bytes>", len(c))
+			}
+			m["files"] = sizes
+		}
+	}
+
+	return r.Value(v)
+}
+
+func auditTarget(ctx *gin.Context, summary interface{}) string {
+	for _, p := range []string{"name", "path", "id"} {
+		if v := ctx.Param(p); v != "" {
+			return v
+		}
+	}
+
+	if m, ok := summary.(map[string]interface{}); ok {
+		for _, k := range []string{"serviceName", "name"} {
+			if v, ok := m[k].(string); ok && v != "" {
+				return v
+			}
+		}
+	}
+
+	return ""
+}
+
+// responseError extracts the message of a JSON error response, falling back to
+// the raw (truncated) body.
+func responseError(body []byte) string {
+	var r struct {
+		Msg   string `json:"msg"`
+		Error string `json:"error"`
+	}
+
+	if json.Unmarshal(body, &r) == nil {
+		if r.Msg != "" {
+			return r.Msg
+		}
+		if r.Error != "" {
+			return r.Error
+		}
+	}
+
+	return string(body)
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"deploybot-service-agent/util"
+)
+
+func TestAuditLogRotationAndQuery(t *testing.T) {
+	l, err := NewAuditLog(t.TempDir(), 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		actor := "alice"
+		if i%2 == 1 {
+			actor = "bob"
+		}
+		if err := l.Record(AuditEntry{Time: start.Add(time.Duration(i) * time.Second), Actor: actor, Action: "DELETE /images", Result: AuditResultSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := l.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 || len(all) >= 10 {
+		t.Fatalf("got %d entries, want rotation to drop the oldest ones", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Time.Before(all[i-1].Time) {
+			t.Fatalf("entries are not ordered oldest first")
+		}
+	}
+
+	bob, _ := l.Query(AuditFilter{Actor: "bob", Since: start.Add(8 * time.Second)})
+	if len(bob) != 1 || !bob[0].Time.Equal(start.Add(9*time.Second)) {
+		t.Errorf("actor/since filter returned %+v", bob)
+	}
+}
+
+func TestSummarizeRequest(t *testing.T) {
+	r, _ := util.NewRedactor(util.DefaultRedactPatterns)
+	summary := summarizeRequest(r, []byte(`{"serviceName":"db","env":["POSTGRES_PASSWORD=hunter2","TZ=UTC"],"files":{"/etc/app.conf":"abc"},"apiKey":"k"}`))
+
+	m := summary.(map[string]interface{})
+	env := m["env"].([]interface{})
+	if env[0] != "POSTGRES_PASSWORD=******" || env[1] != "TZ=UTC" {
+		t.Errorf("env = %v", env)
+	}
+	if m["files"].(map[string]interface{})["/etc/app.conf"] != "<3 bytes>" {
+		t.Errorf("files = %v", m["files"])
+	}
+	if m["apiKey"] != "******" || m["serviceName"] != "db" {
+		t.Errorf("summary = %v", m)
+	}
+}
@@ -0,0 +1,447 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AuthMethodApiKey      = "api_key"
+	AuthMethodToken       = "token"
+	AuthMethodCertificate = "certificate"
+
+	principalKey = "principal"
+)
+
+var (
+	ErrMissingCredentials  = errors.New("missing credentials")
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrTokenExpired        = errors.New("token expired")
+	ErrPermissionDenied    = errors.New("permission denied")
+	ErrServiceNotPermitted = errors.New("service not permitted")
+)
+
+// Role is a capability level; each role includes the permissions of the roles
+// below it.
+type Role string
+
+const (
+	RoleRead     Role = "read"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleLevels = map[Role]int{RoleRead: 1, RoleOperator: 2, RoleAdmin: 3}
+
+func (r Role) Valid() bool {
+	return roleLevels[r] > 0
+}
+
+func (r Role) Includes(other Role) bool {
+	return roleLevels[r] >= roleLevels[other]
+}
+
+type AuthConfig struct {
+	ApiKey      string
+	TokenSecret string
+	TokensFile  string
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject     string        `json:"subject"`
+	Method      string        `json:"method"`
+	Role        Role          `json:"role"`
+	Services    []string      `json:"services,omitempty"`
+	ExpiresAt   time.Time     `json:"expiresAt,omitempty"`
+	Certificate *CertIdentity `json:"certificate,omitempty"`
+}
+
+// CertIdentity describes the verified TLS client certificate of a request.
+type CertIdentity struct {
+	CommonName   string   `json:"commonName"`
+	DNSNames     []string `json:"dnsNames,omitempty"`
+	URIs         []string `json:"uris,omitempty"`
+	Emails       []string `json:"emails,omitempty"`
+	SerialNumber string   `json:"serialNumber"`
+}
+
+func (c *CertIdentity) names() []string {
+	return append(append(append([]string{c.CommonName}, c.DNSNames...), c.URIs...), c.Emails...)
+}
+
+// CanAccessService reports whether the principal's service globs match name.
+// A principal without globs may access every service.
+func (p *Principal) CanAccessService(name string) bool {
+	return matchesAny(p.Services, name)
+}
+
+// StaticToken is a pre-shared bearer token defined in the tokens file.
+type StaticToken struct {
+	Name      string    `json:"name"`
+	Token     string    `json:"token"`
+	Role      Role      `json:"role"`
+	Services  []string  `json:"services"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ClientRule grants a role to TLS clients whose certificate common name or
+// subject alternative name equals Name.
+type ClientRule struct {
+	Name     string   `json:"name"`
+	Role     Role     `json:"role"`
+	Services []string `json:"services"`
+}
+
+type tokensFile struct {
+	Tokens  []StaticToken `json:"tokens"`
+	Clients []ClientRule  `json:"clients"`
+}
+
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Role      Role     `json:"role"`
+	Services  []string `json:"svc,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+type Authenticator struct {
+	cfg     AuthConfig
+	tokens  []StaticToken
+	clients []ClientRule
+}
+
+func NewAuthenticator(cfg AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{cfg: cfg}
+
+	if cfg.TokensFile != "" {
+		f, err := loadTokensFile(cfg.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens, a.clients = f.Tokens, f.Clients
+	}
+
+	if cfg.ApiKey == "" && cfg.TokenSecret == "" && len(a.tokens) == 0 && len(a.clients) == 0 {
+		return nil, errors.New("authentication requires an API key, a token secret or a tokens file")
+	}
+
+	return a, nil
+}
+
+func loadTokensFile(file string) (*tokensFile, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var f tokensFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	for _, c := range f.Clients {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%s: client rule without a name", file)
+		}
+		if !c.Role.Valid() {
+			return nil, fmt.Errorf("%s: client %q has invalid role %q", file, c.Name, c.Role)
+		}
+		if err := validateGlobs(c.Services); err != nil {
+			return nil, fmt.Errorf("%s: client %q: %w", file, c.Name, err)
+		}
+	}
+
+	for _, t := range f.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("%s: token %q is empty", file, t.Name)
+		}
+		if !t.Role.Valid() {
+			return nil, fmt.Errorf("%s: token %q has invalid role %q", file, t.Name, t.Role)
+		}
+		if err := validateGlobs(t.Services); err != nil {
+			return nil, fmt.Errorf("%s: token %q: %w", file, t.Name, err)
+		}
+	}
+
+	return &f, nil
+}
+
+// Middleware rejects requests that carry neither a valid X-Api-Key header, a
+// valid, unexpired bearer token nor a verified client certificate matching a
+// client rule. The client certificate identity, if any, is attached to the
+// principal in every case.
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		cert := clientCertIdentity(ctx.Request)
+
+		p, err := a.authenticate(ctx.Request)
+
+		if err == ErrMissingCredentials && cert != nil {
+			p, err = a.authenticateCert(cert)
+		}
+
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, model.ApiResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		p.Certificate = cert
+
+		ctx.Set(principalKey, p)
+		ctx.Next()
+	}
+}
+
+func (a *Authenticator) authenticateCert(cert *CertIdentity) (*Principal, error) {
+	for _, c := range a.clients {
+		for _, n := range cert.names() {
+			if n == c.Name {
+				return &Principal{Subject: n, Method: AuthMethodCertificate, Role: c.Role, Services: c.Services}, nil
+			}
+		}
+	}
+
+	return nil, errors.New("client certificate not authorized")
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		if a.cfg.ApiKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(a.cfg.ApiKey)) != 1 {
+			return nil, ErrInvalidCredentials
+		}
+
+		return &Principal{Subject: AuthMethodApiKey, Method: AuthMethodApiKey, Role: RoleAdmin}, nil
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrMissingCredentials
+	}
+
+	now := time.Now()
+
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) != 1 {
+			continue
+		}
+
+		if !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt) {
+			return nil, ErrTokenExpired
+		}
+
+		return &Principal{Subject: t.Name, Method: AuthMethodToken, Role: t.Role, Services: t.Services, ExpiresAt: t.ExpiresAt}, nil
+	}
+
+	if a.cfg.TokenSecret == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	claims, err := verifyToken(a.cfg.TokenSecret, token, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{Subject: claims.Subject, Method: AuthMethodToken, Role: claims.Role, Services: claims.Services, ExpiresAt: time.Unix(claims.ExpiresAt, 0)}, nil
+}
+
+// Require rejects callers whose role does not include role. It must be
+// chained after Middleware.
+func (a *Authenticator) Require(role Role) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p := PrincipalFrom(ctx)
+
+		if p == nil || !p.Role.Includes(role) {
+			abortForbidden(ctx, fmt.Errorf("%w: %s role required", ErrPermissionDenied, role))
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// authorizeService aborts the request and returns false when the caller is
+// restricted to services that do not match name. Unauthenticated routes
+// (authentication disabled) are always allowed.
+func authorizeService(ctx *gin.Context, name string) bool {
+	p := PrincipalFrom(ctx)
+
+	if p == nil || p.CanAccessService(name) {
+		return true
+	}
+
+	abortForbidden(ctx, fmt.Errorf("%w: %s", ErrServiceNotPermitted, name))
+	return false
+}
+
+// authorizeTask aborts the request and returns false when the caller may not
+// run or cancel a task of type taskType with config conf. Deploy tasks are
+// checked against the caller's services. Build tasks clone a repository and
+// push an image of the pipeline's choosing, so callers restricted to services
+// may not run them.
+func authorizeTask(ctx *gin.Context, taskType string, conf interface{}) bool {
+	p := PrincipalFrom(ctx)
+
+	if p == nil || len(p.Services) == 0 {
+		return true
+	}
+
+	if taskType == types.DeployTask {
+		var c model.DeployConfig
+		decodeConfig(conf, &c)
+		return authorizeService(ctx, c.ServiceName)
+	}
+
+	abortForbidden(ctx, fmt.Errorf("%w: %s tasks require a token not restricted to services", ErrPermissionDenied, taskType))
+	return false
+}
+
+func abortForbidden(ctx *gin.Context, err error) {
+	ctx.AbortWithStatusJSON(http.StatusForbidden, model.ApiResponse{Msg: err.Error(), Code: types.CodeClientError})
+}
+
+// PrincipalFrom returns the caller attached by the authentication middleware,
+// or nil when the route is not authenticated.
+func PrincipalFrom(ctx *gin.Context) *Principal {
+	v, ok := ctx.Get(principalKey)
+	if !ok {
+		return nil
+	}
+
+	p, _ := v.(*Principal)
+	return p
+}
+
+// IssueToken creates a bearer token for subject that expires after ttl,
+// restricted to role and, when services is not empty, to matching service
+// names. The token is a base64url JSON claim set followed by its HMAC-SHA256
+// signature.
+func IssueToken(secret, subject string, role Role, services []string, ttl time.Duration) (string, error) {
+	if secret == "" {
+		return "", errors.New("token secret is empty")
+	}
+
+	if !role.Valid() {
+		return "", fmt.Errorf("invalid role %q", role)
+	}
+
+	if err := validateGlobs(services); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(tokenClaims{Subject: subject, Role: role, Services: services, ExpiresAt: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + signToken(secret, encoded), nil
+}
+
+func verifyToken(secret, token string, now time.Time) (*tokenClaims, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signToken(secret, encoded))) {
+		return nil, ErrInvalidCredentials
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	if !claims.Role.Valid() {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &claims, nil
+}
+
+func signToken(secret, encoded string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// clientCertIdentity returns the identity of the verified client certificate
+// of r, or nil when the connection is not mutually authenticated.
+func clientCertIdentity(r *http.Request) *CertIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return newCertIdentity(r.TLS.VerifiedChains[0][0])
+}
+
+func newCertIdentity(c *x509.Certificate) *CertIdentity {
+	id := &CertIdentity{
+		CommonName:   c.Subject.CommonName,
+		DNSNames:     c.DNSNames,
+		Emails:       c.EmailAddresses,
+		SerialNumber: c.SerialNumber.String(),
+	}
+
+	for _, u := range c.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+
+	return id
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+func validateGlobs(globs []string) error {
+	for _, g := range globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("invalid service pattern %q", g)
+		}
+	}
+
+	return nil
+}
+
+func matchesAny(globs []string, name string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerifyToken(t *testing.T) {
+	token, err := IssueToken("secret", "ci", RoleOperator, []string{"web-*"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := verifyToken("secret", token, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "ci" || claims.Role != RoleOperator {
+		t.Errorf("claims = %+v, want subject ci with role operator", claims)
+	}
+
+	if _, err := verifyToken("other", token, time.Now()); err != ErrInvalidCredentials {
+		t.Errorf("wrong secret: err = %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	if _, err := verifyToken("secret", token, time.Now().Add(2*time.Hour)); err != ErrTokenExpired {
+		t.Errorf("expired: err = %v, want %v", err, ErrTokenExpired)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, err := NewAuthenticator(AuthConfig{ApiKey: "key", TokenSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := IssueToken("secret", "ci", RoleRead, nil, time.Hour)
+
+	cases := []struct {
+		header, value string
+		want          error
+	}{
+		{"X-Api-Key", "key", nil},
+		{"X-Api-Key", "wrong", ErrInvalidCredentials},
+		{"Authorization", "Bearer " + token, nil},
+		{"Authorization", "Bearer " + token + "x", ErrInvalidCredentials},
+		{"", "", ErrMissingCredentials},
+	}
+
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/services", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+
+		if _, err := a.authenticate(r); err != c.want {
+			t.Errorf("%s %q: err = %v, want %v", c.header, c.value, err, c.want)
+		}
+	}
+}
+
+func TestPrincipalPermissions(t *testing.T) {
+	p := &Principal{Role: RoleOperator, Services: []string{"web-*", "api"}}
+
+	if !p.Role.Includes(RoleRead) || !p.Role.Includes(RoleOperator) || p.Role.Includes(RoleAdmin) {
+		t.Errorf("operator role inclusion is wrong")
+	}
+
+	for name, want := range map[string]bool{"web-frontend": true, "api": true, "api-v2": false, "postgres": false} {
+		if got := p.CanAccessService(name); got != want {
+			t.Errorf("CanAccessService(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// issueTestCert returns a client certificate for cn and dnsNames signed by ca,
+// or a self-signed CA certificate when ca is nil.
+func issueTestCert(t *testing.T, ca *tls.Certificate, cn string, dnsNames []string, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertificateAuth(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(tokensFile, []byte(`{"clients": [{"name": "deployer.example.com", "role": "operator"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuthenticator(AuthConfig{TokenSecret: "secret", TokensFile: tokensFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := issueTestCert(t, nil, "test-ca", nil, time.Now().Add(time.Hour))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	g := gin.New()
+	g.GET("/whoami", a.Middleware(), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, PrincipalFrom(ctx))
+	})
+
+	srv := httptest.NewUnstartedServer(g)
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+
+	do := func(cert tls.Certificate, token string) (*Principal, int, error) {
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/whoami", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := (&http.Client{Transport: tr}).Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer res.Body.Close()
+
+		var p Principal
+		json.NewDecoder(res.Body).Decode(&p)
+		return &p, res.StatusCode, nil
+	}
+
+	// A certificate matching a client rule by SAN gets the rule's role.
+	valid := issueTestCert(t, &ca, "ci-runner", []string{"deployer.example.com"}, time.Now().Add(time.Hour))
+
+	p, code, err := do(valid, "")
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("valid certificate: got %d, err %v", code, err)
+	}
+	if p.Method != AuthMethodCertificate || p.Role != RoleOperator || p.Subject != "deployer.example.com" || p.Certificate.CommonName != "ci-runner" {
+		t.Errorf("valid certificate: principal = %+v", p)
+	}
+
+	// A certificate whose CN and SANs match no rule is refused.
+	unknown := issueTestCert(t, &ca, "ci-runner", []string{"other.example.com"}, time.Now().Add(time.Hour))
+	if _, code, err := do(unknown, ""); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("unknown certificate: got %d, err %v, want 401", code, err)
+	}
+
+	// An expired certificate fails the handshake.
+	expired := issueTestCert(t, &ca, "ci-runner", []string{"deployer.example.com"}, time.Now().Add(-time.Hour))
+	if _, code, err := do(expired, ""); err == nil {
+		t.Errorf("expired certificate: got %d, want a handshake error", code)
+	}
+
+	// An invalid token is refused even with a valid certificate.
+	if _, code, err := do(valid, "invalid"); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("valid certificate with an invalid token: got %d, err %v, want 401", code, err)
+	}
+
+	// A valid token takes precedence, and the certificate is still attached.
+	token, _ := IssueToken("secret", "ci", RoleRead, nil, time.Hour)
+
+	p, code, err = do(valid, token)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("valid certificate with a valid token: got %d, err %v", code, err)
+	}
+	if p.Method != AuthMethodToken || p.Role != RoleRead || p.Certificate == nil {
+		t.Errorf("valid certificate with a valid token: principal = %+v", p)
+	}
+}
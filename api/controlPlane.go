@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	controlPlaneRetryBase = 500 * time.Millisecond
+	controlPlaneRetryMax  = 30 * time.Second
+
+	// Response bodies larger than this are not decoded.
+	controlPlaneBodyLimit = 16 << 20
+)
+
+// ApiError is a response of the control plane reporting a failure, either
+// with its status code or with a non-zero code in the response envelope.
+type ApiError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Code       int
+	Msg        string
+}
+
+func (e *ApiError) Error() string {
+	msg := e.Msg
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, msg)
+}
+
+// Temporary reports whether the request may succeed when sent again.
+func (e *ApiError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+// Rejected reports whether the control plane refused the request itself, as
+// malformed or about an unknown resource, so that sending it again can never
+// succeed. Authentication failures are not rejections: they last until the
+// API key is fixed.
+func (e *ApiError) Rejected() bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return true
+	}
+
+	// A failure code in the envelope of a successful response.
+	return e.StatusCode >= 200 && e.StatusCode < 300
+}
+
+// ControlPlaneClient sends requests to the deploybot API with a timeout per
+// attempt, retrying network errors and temporary failures with exponential
+// backoff.
+type ControlPlaneClient struct {
+	baseUrl    string
+	apiKey     string
+	maxRetries int
+	client     *http.Client
+}
+
+func NewControlPlaneClient(baseUrl, apiKey string, timeout time.Duration, maxRetries int) *ControlPlaneClient {
+	return &ControlPlaneClient{baseUrl: baseUrl, apiKey: apiKey, maxRetries: maxRetries, client: &http.Client{Timeout: timeout}}
+}
+
+// Do sends body as JSON and decodes the response into out when it is not nil.
+func (c *ControlPlaneClient) Do(ctx context.Context, method, path string, body, out interface{}) error {
+	var bs []byte
+	if body != nil {
+		var err error
+		if bs, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, path, bs, out)
+
+		var apiErr *ApiError
+		if err == nil || attempt >= c.maxRetries || ctx.Err() != nil || (errors.As(err, &apiErr) && !apiErr.Temporary()) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff(attempt, controlPlaneRetryBase, controlPlaneRetryMax)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (c *ControlPlaneClient) send(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, r)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-Api-Key", c.apiKey)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	bs, err := io.ReadAll(io.LimitReader(res.Body, controlPlaneBodyLimit))
+	if err != nil {
+		return err
+	}
+
+	// The API answers with a {code, msg, payload} envelope where a non-zero
+	// code reports a failure.
+	var envelope struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	json.Unmarshal(bs, &envelope)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 || envelope.Code != 0 {
+		return &ApiError{Method: method, Path: path, StatusCode: res.StatusCode, Code: envelope.Code, Msg: envelope.Msg}
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(bs, out); err != nil {
+			return fmt.Errorf("%s %s: invalid response: %w", method, path, err)
+		}
+	}
+
+	return nil
+}
+
+// backoff returns the delay before retry attempt+1: base doubled on every
+// attempt up to max, with up to 50% random jitter.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := max
+	if attempt < 30 {
+		d = min(base<<attempt, max)
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/util"
+)
+
+const (
+	outboxRetryBase = time.Second
+	outboxRetryMax  = 5 * time.Minute
+)
+
+type outboxMessage struct {
+	Id        string          `json:"id"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Body      json.RawMessage `json:"body"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// taskId returns the pipeline and task ids of the task the request is about,
+// as in GET /tasks, or "unknown".
+func (m *outboxMessage) taskId() string {
+	var body struct {
+		PipelineId types.ObjectId
+		TaskId     types.ObjectId
+	}
+
+	if json.Unmarshal(m.Body, &body) != nil || !body.TaskId.Valid() {
+		return "unknown"
+	}
+	return queuedTaskId(body.PipelineId, body.TaskId)
+}
+
+// Outbox delivers requests to the control plane in the order they were
+// queued, retrying until they are accepted. Each request is kept in a file
+// until it is delivered, so that the ones still pending are sent after a
+// restart.
+type Outbox struct {
+	dir    string
+	client *ControlPlaneClient
+
+	mu      sync.Mutex
+	seq     int64
+	pending []*outboxMessage
+	notify  chan struct{}
+
+	// empty is closed, and replaced, whenever the last pending request is
+	// delivered.
+	empty chan struct{}
+}
+
+func NewOutbox(dir string, client *ControlPlaneClient) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{dir: dir, client: client, notify: make(chan struct{}, 1), empty: make(chan struct{})}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		bs, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		var m outboxMessage
+		if err := json.Unmarshal(bs, &m); err != nil {
+			log.Printf("Skipping corrupt outbox message %s: %v", f, err)
+			continue
+		}
+		o.pending = append(o.pending, &m)
+	}
+
+	// Ids start with a fixed width timestamp, so they sort in queuing order.
+	sort.Slice(o.pending, func(i, j int) bool { return o.pending[i].Id < o.pending[j].Id })
+
+	if len(o.pending) > 0 {
+		log.Printf("Replaying %d undelivered control plane request(s)", len(o.pending))
+	}
+
+	return o, nil
+}
+
+// Send queues a request with body sent as JSON. It returns once the request is
+// persisted, not delivered.
+func (o *Outbox) Send(method, path string, body interface{}) error {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+	o.seq++
+	m := &outboxMessage{Id: fmt.Sprintf("%020d-%06d", now.UnixNano(), o.seq%1000000), Method: method, Path: path, Body: bs, CreatedAt: now}
+
+	mbs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := util.WriteFileAtomic(filepath.Join(o.dir, m.Id+".json"), mbs, 0600); err != nil {
+		return err
+	}
+
+	o.pending = append(o.pending, m)
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Len returns the number of requests not delivered yet.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.pending)
+}
+
+// Flush waits until every queued request is delivered or ctx is done. The
+// requests left when ctx is done stay on disk and are sent after a restart.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	n, empty := len(o.pending), o.empty
+	o.mu.Unlock()
+
+	if n == 0 {
+		return nil
+	}
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d control plane request(s) not delivered: %w", o.Len(), ctx.Err())
+	}
+}
+
+// Run delivers the queued requests until ctx is done. A request rejected by
+// the control plane as invalid is dropped; any other failure is retried with
+// backoff, holding back the requests queued after it.
+func (o *Outbox) Run(ctx context.Context) {
+	attempt := 0
+
+	for {
+		o.mu.Lock()
+		var m *outboxMessage
+		if len(o.pending) > 0 {
+			m = o.pending[0]
+		}
+		o.mu.Unlock()
+
+		if m == nil {
+			select {
+			case <-o.notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := o.client.Do(ctx, m.Method, m.Path, m.Body, nil)
+
+		// Only the requests the control plane rejects are dropped; any other
+		// failure, including a wrong API key, is retried.
+		var apiErr *ApiError
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Rejected()) {
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := backoff(attempt, outboxRetryBase, outboxRetryMax)
+			log.Printf("Error delivering %s %s, retrying in %s: %v", m.Method, m.Path, delay.Round(time.Second), err)
+			attempt++
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Dropping %s %s of task %s rejected by the control plane: %v", m.Method, m.Path, m.taskId(), err)
+		}
+
+		attempt = 0
+		o.remove(m)
+	}
+}
+
+func (o *Outbox) remove(m *outboxMessage) {
+	if err := os.Remove(filepath.Join(o.dir, m.Id+".json")); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing outbox message %s: %v", m.Id, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.pending) > 0 && o.pending[0] == m {
+		o.pending = o.pending[1:]
+	}
+
+	if len(o.pending) == 0 {
+		close(o.empty)
+		o.empty = make(chan struct{})
+	}
+}
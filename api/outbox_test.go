@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboxReplay(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	fail := true
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		var v struct{ Status string }
+		json.Unmarshal(body, &v)
+		received = append(received, v.Status)
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	client := NewControlPlaneClient(srv.URL, "key", time.Second, 0)
+
+	o, err := NewOutbox(dir, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Send("PUT", "/taskStatus", map[string]string{"Status": "InProgress"})
+	o.Send("PUT", "/taskStatus", map[string]string{"Status": "Done"})
+
+	// The API is down until the agent restarts.
+	ctx, cancel := context.WithCancel(context.Background())
+	go o.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	o, err = NewOutbox(dir, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Len() != 2 {
+		t.Fatalf("got %d pending messages after restart, want 2", o.Len())
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+
+	for deadline := time.Now().Add(time.Second); o.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0] != "InProgress" || received[1] != "Done" {
+		t.Fatalf("got %v, want the updates delivered in order", received)
+	}
+}
+
+func TestControlPlaneClientRejects(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"code":2,"msg":"task not found"}`))
+	}))
+	defer srv.Close()
+
+	err := NewControlPlaneClient(srv.URL, "key", time.Second, 3).Do(context.Background(), "GET", "/task", nil, nil)
+
+	if apiErr, ok := err.(*ApiError); !ok || apiErr.Msg != "task not found" || apiErr.Temporary() {
+		t.Fatalf("got %v, want a permanent API error", err)
+	}
+	if calls != 1 {
+		t.Fatalf("got %d calls, want no retry", calls)
+	}
+}
+
+func TestOutboxFlush(t *testing.T) {
+	var mu sync.Mutex
+	down := false
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+
+	o, err := NewOutbox(t.TempDir(), NewControlPlaneClient(srv.URL, "key", time.Second, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+
+	o.Send("PUT", "/taskStatus", map[string]string{"Status": "InProgress"})
+	o.Send("PUT", "/taskStatus", map[string]string{"Status": "Done"})
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), time.Second)
+	defer flushCancel()
+	if err := o.Flush(flushCtx); err != nil || o.Len() != 0 {
+		t.Fatalf("flush: %v, %d pending", err, o.Len())
+	}
+
+	mu.Lock()
+	down = true
+	mu.Unlock()
+
+	o.Send("PUT", "/taskStatus", map[string]string{"Status": "Done"})
+
+	flushCtx, flushCancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer flushCancel()
+	if err := o.Flush(flushCtx); err == nil || o.Len() != 1 {
+		t.Fatalf("flush with the API down: %v, %d pending", err, o.Len())
+	}
+}
+
+func TestOutboxRetriesAuthFailures(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusUnauthorized
+	var received []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		var v struct{ Status string }
+		json.Unmarshal(body, &v)
+
+		if v.Status == "Malformed" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		received = append(received, v.Status)
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+
+	o, err := NewOutbox(t.TempDir(), NewControlPlaneClient(srv.URL, "key", time.Second, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+
+	o.Send("PUT", "/taskStatus", map[string]string{"Status": "Malformed"})
+	o.Send("PUT", "/taskStatus", map[string]string{"Status": "Done"})
+
+	// A request the control plane rejects is dropped; one refused with a
+	// wrong API key is kept until the key is fixed.
+	time.Sleep(100 * time.Millisecond)
+	if o.Len() != 1 {
+		t.Fatalf("got %d pending requests, want the one refused for authentication", o.Len())
+	}
+
+	mu.Lock()
+	status = http.StatusForbidden
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	if o.Len() != 1 {
+		t.Fatalf("got %d pending requests after a 403, want 1", o.Len())
+	}
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer flushCancel()
+	if err := o.Flush(flushCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0] != "Done" {
+		t.Fatalf("got %v, want the update refused for authentication", received)
+	}
+}
+
+func TestApiErrorRejected(t *testing.T) {
+	for status, want := range map[int]bool{
+		http.StatusOK:                  true,
+		http.StatusBadRequest:          true,
+		http.StatusNotFound:            true,
+		http.StatusUnprocessableEntity: true,
+		http.StatusUnauthorized:        false,
+		http.StatusForbidden:           false,
+		http.StatusTooManyRequests:     false,
+		http.StatusBadGateway:          false,
+	} {
+		if got := (&ApiError{StatusCode: status}).Rejected(); got != want {
+			t.Errorf("status %d: rejected %v, want %v", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Idle buckets are dropped once the limiter tracks more clients than this.
+const maxRateLimitBuckets = 10000
+
+// RateLimit allows Rate requests per second on average with bursts of up to
+// Burst requests.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses "<rate>:<burst>", e.g. "0.5:3". An empty string
+// disables rate limiting and returns a zero RateLimit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+
+	rate, burst, ok := strings.Cut(s, ":")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected <rate>:<burst>", s)
+	}
+
+	var l RateLimit
+	var err error
+
+	l.Rate, err = strconv.ParseFloat(rate, 64)
+	if err == nil {
+		l.Burst, err = strconv.Atoi(burst)
+	}
+
+	if err != nil || l.Rate <= 0 || l.Burst < 1 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected a positive rate and burst", s)
+	}
+
+	return l, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket per client. Clients are identified by their
+// principal when authenticated and by their IP address otherwise.
+type RateLimiter struct {
+	limit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token from the bucket of key and returns how long the client
+// has to wait when none is left.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	return l.take(key, now, true)
+}
+
+// Check is like Allow but leaves the token in the bucket.
+func (l *RateLimiter) Check(key string, now time.Time) (bool, time.Duration) {
+	return l.take(key, now, false)
+}
+
+func (l *RateLimiter) take(key string, now time.Time, consume bool) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	}
+
+	if consume {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// prune drops the buckets that have refilled completely, since a fresh bucket
+// behaves the same.
+func (l *RateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= float64(l.limit.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Middleware rejects requests over the limit with 429. It must be chained
+// after the authentication middleware to limit per principal.
+func (l *RateLimiter) Middleware() gin.HandlerFunc {
+	return l.MiddlewareWhen(nil)
+}
+
+// MiddlewareWhen is like Middleware but only counts the requests for which
+// cond returns true. A nil cond counts every request.
+func (l *RateLimiter) MiddlewareWhen(cond func(*gin.Context) bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if l.limit.Rate == 0 || (cond != nil && !cond(ctx)) {
+			ctx.Next()
+			return
+		}
+
+		key := "ip:" + ctx.ClientIP()
+		if p := PrincipalFrom(ctx); p != nil {
+			key = p.Method + ":" + p.Subject
+		}
+
+		if ok, wait := l.Allow(key, time.Now()); !ok {
+			ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, model.ApiResponse{Msg: "rate limit exceeded", Code: types.CodeClientError})
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// FailureMiddleware limits, per client IP, the requests answered with one of
+// statuses, e.g. failed authentications. Once the bucket of an IP is empty,
+// its requests are rejected with 429 before reaching the next handlers, so it
+// must be chained before the authentication middleware.
+func (l *RateLimiter) FailureMiddleware(statuses ...int) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if l.limit.Rate == 0 {
+			ctx.Next()
+			return
+		}
+
+		key := "ip:" + ctx.ClientIP()
+		if ok, wait := l.Check(key, time.Now()); !ok {
+			ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, model.ApiResponse{Msg: "too many failed requests", Code: types.CodeClientError})
+			return
+		}
+
+		ctx.Next()
+
+		for _, s := range statuses {
+			if ctx.Writer.Status() == s {
+				l.Allow(key, time.Now())
+				return
+			}
+		}
+	}
+}
+
+// BodyLimit caps request bodies at maxBytes. Requests declaring a larger body
+// are rejected with 413 right away; others fail when reading past the limit.
+// A maxBytes of 0 or less disables the limit.
+func BodyLimit(maxBytes int64) gin.HandlerFunc {
+	if maxBytes <= 0 {
+		return func(ctx *gin.Context) {
+			ctx.Next()
+		}
+	}
+
+	return func(ctx *gin.Context) {
+		if ctx.Request.ContentLength > maxBytes {
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, model.ApiResponse{Msg: "request body too large", Code: types.CodeClientError})
+			return
+		}
+
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxBytes)
+		ctx.Next()
+	}
+}
+
+// bodyErrorStatus maps a request body read error to its response status.
+func bodyErrorStatus(err error) int {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
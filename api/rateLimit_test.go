@@ -0,0 +1,128 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Rate: 1, Burst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Fatalf("request %d within burst was rejected", i)
+		}
+	}
+
+	ok, wait := l.Allow("a", now)
+	if ok || wait != time.Second {
+		t.Errorf("over burst: ok = %v, wait = %v, want rejection with 1s wait", ok, wait)
+	}
+
+	if ok, _ := l.Allow("b", now); !ok {
+		t.Error("other client was rejected")
+	}
+
+	if ok, _ := l.Allow("a", now.Add(time.Second)); !ok {
+		t.Error("request after refill was rejected")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	if l, err := ParseRateLimit("0.5:3"); err != nil || l != (RateLimit{Rate: 0.5, Burst: 3}) {
+		t.Errorf("ParseRateLimit(0.5:3) = %+v, %v", l, err)
+	}
+
+	for _, s := range []string{"5", "x:1", "1:0", "-1:2"} {
+		if _, err := ParseRateLimit(s); err == nil {
+			t.Errorf("ParseRateLimit(%q) succeeded", s)
+		}
+	}
+}
+
+func TestFailureMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	g := gin.New()
+	g.Use(NewRateLimiter(RateLimit{Rate: 0.001, Burst: 2}).FailureMiddleware(http.StatusUnauthorized))
+	g.GET("/", func(ctx *gin.Context) {
+		if ctx.GetHeader("X-Api-Key") != "good" {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		ctx.Status(http.StatusOK)
+	})
+
+	do := func(key, addr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Api-Key", key)
+		req.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Successful requests are not counted.
+	for i := 0; i < 5; i++ {
+		if code := do("good", "10.0.0.1"); code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := do("bad", "10.0.0.1"); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: got %d, want 401", i, code)
+		}
+	}
+
+	// Past the burst of failures, even a valid key is rejected from that IP.
+	if code := do("good", "10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", code)
+	}
+	if code := do("bad", "10.0.0.2"); code != http.StatusUnauthorized {
+		t.Fatalf("other IP: got %d, want 401", code)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	post := func(maxBytes int64, body string) int {
+		g := gin.New()
+		g.Use(BodyLimit(maxBytes))
+		g.POST("/", func(ctx *gin.Context) {
+			if _, err := io.ReadAll(ctx.Request.Body); err != nil {
+				ctx.Status(bodyErrorStatus(err))
+				return
+			}
+			ctx.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		maxBytes int64
+		body     string
+		want     int
+	}{
+		{4, "abcd", http.StatusOK},
+		{4, "abcde", http.StatusRequestEntityTooLarge},
+		// 0 disables the limit.
+		{0, "abcde", http.StatusOK},
+		{-1, "abcde", http.StatusOK},
+	} {
+		if code := post(c.maxBytes, c.body); code != c.want {
+			t.Errorf("limit %d, body %q: got %d, want %d", c.maxBytes, c.body, code, c.want)
+		}
+	}
+}
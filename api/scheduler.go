@@ -1,14 +1,18 @@
 package api
 
 import (
-	"bytes"
-	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	types "deploybot-service-agent/deploybot-types"
@@ -21,8 +25,8 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// var gTicker *time.Ticker
-var gEventQueue = list.New()
+// buildDir holds the checkouts of the repositories being built.
+const buildDir = "/var/temp"
 
 type SchedulerConfig struct {
 	ApiBaseUrl   string
@@ -32,169 +36,428 @@ type SchedulerConfig struct {
 	DhPassword   string
 	RepoUsername string
 	RepoPassword string
+
+	HostPathAllowlist []string
+
+	DataDir       string
+	AuditMaxSize  int64
+	AuditMaxFiles int
+	SecretsKey    string
+
+	RedactPatterns []string
+
+	TaskWorkers       int
+	BuildConcurrency  int
+	DeployConcurrency int
+	TaskLogUpload     bool
+
+	TaskHistoryRetention time.Duration
+	TaskDedupWindow      time.Duration
+
+	ApiTimeout    time.Duration
+	ApiMaxRetries int
+
+	AgentMode    string
+	AgentId      string
+	PollWait     time.Duration
+	PollInterval time.Duration
+
+	Version            string
+	HeartbeatInterval  time.Duration
+	HeartbeatDiskPaths []string
 }
 
 type Scheduler struct {
-	cHelper *util.ContainerHelper
-	cfg     SchedulerConfig
+	cHelper  *util.ContainerHelper
+	cfg      SchedulerConfig
+	audit    *AuditLog
+	secrets  *util.SecretStore
+	redactor *util.Redactor
+	queue    *TaskQueue
+	slots    *taskSlots
+	logs     *TaskLogs
+	history  *TaskHistory
+	api      *ControlPlaneClient
+	outbox   *Outbox
+	started  time.Time
+
+	workers    sync.WaitGroup
+	draining   atomic.Bool
+	stopOutbox context.CancelFunc
+
+	// abortCtx is cancelled when draining times out, so that requests made on
+	// behalf of the running tasks stop holding the shutdown.
+	abortCtx context.Context
+	abort    context.CancelFunc
 }
 
-func NewScheduler(cfg SchedulerConfig) *Scheduler {
-	return &Scheduler{cHelper: util.NewContainerHelper(cfg.DockerHost, util.DhCredentials{Username: cfg.DhUsername, Password: cfg.DhPassword}), cfg: cfg}
+func NewScheduler(cfg SchedulerConfig) (*Scheduler, error) {
+	if cfg.AgentId == "" {
+		cfg.AgentId, _ = os.Hostname()
+	}
+
+	audit, err := NewAuditLog(filepath.Join(cfg.DataDir, "audit"), cfg.AuditMaxSize, cfg.AuditMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	guard, err := util.NewPathGuard(cfg.HostPathAllowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := util.LoadOrCreateSecretKey(cfg.SecretsKey, filepath.Join(cfg.DataDir, "secrets.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := util.NewSecretStore(filepath.Join(cfg.DataDir, "secrets.json"), key)
+	if err != nil {
+		return nil, err
+	}
+
+	redactor, err := util.NewRedactor(cfg.RedactPatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	api := NewControlPlaneClient(cfg.ApiBaseUrl, cfg.ApiKey, cfg.ApiTimeout, cfg.ApiMaxRetries)
+
+	outbox, err := NewOutbox(filepath.Join(cfg.DataDir, "outbox"), api)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, abandoned, err := NewTaskQueue(filepath.Join(cfg.DataDir, "queue"))
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := NewTaskLogs(filepath.Join(cfg.DataDir, "tasks"))
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := NewTaskHistory(filepath.Join(cfg.DataDir, "tasks"), cfg.TaskHistoryRetention, cfg.TaskDedupWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scheduler{cHelper: util.NewContainerHelper(cfg.DockerHost, util.DhCredentials{Username: cfg.DhUsername, Password: cfg.DhPassword}, guard, secrets), cfg: cfg, audit: audit, secrets: secrets, redactor: redactor, queue: queue, logs: logs, history: history, api: api, outbox: outbox, started: time.Now().UTC()}
+	s.abortCtx, s.abort = context.WithCancel(context.Background())
+	s.slots = newTaskSlots(map[string]int{types.BuildTask: cfg.BuildConcurrency, types.DeployTask: cfg.DeployConcurrency})
+
+	for _, t := range abandoned {
+		s.finishTask(t, time.Now(), types.TaskFailed, fmt.Errorf("task interrupted %d times, giving up", t.Attempts))
+	}
+
+	orphans := history.ReleaseOrphans(func(id string) bool {
+		_, ok := queue.Get(id)
+		return ok
+	})
+	for _, id := range orphans {
+		log.Printf("Task %s was claimed but never queued, it will run when delivered again", id)
+	}
+
+	return s, nil
 }
 
-func (s *Scheduler) PushEvent(e types.Event) {
-	gEventQueue.PushBack(e)
+// StartWorkers starts the workers running the queued tasks, including the ones
+// recovered from a previous run. A worker skips the tasks whose type is at its
+// concurrency limit or whose service is being deployed, so they run in order
+// once a slot frees up.
+func (s *Scheduler) StartWorkers() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopOutbox = cancel
+	go s.outbox.Run(ctx)
+
+	n := s.cfg.TaskWorkers
+	if n < 1 {
+		n = 1
+	}
+
+	s.workers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer s.workers.Done()
+
+			for {
+				ctx, cancel := context.WithCancelCause(context.Background())
+
+				t, ok := s.queue.Pop(func(t *QueuedTask) bool {
+					return s.slots.tryAcquire(t.Type, taskService(t))
+				}, cancel)
+				if !ok {
+					cancel(nil)
+					return
+				}
+
+				s.runTask(ctx, t)
+
+				cancel(nil)
+				s.slots.release(t.Type, taskService(t))
+				s.queue.Wake()
+			}
+		}()
+	}
 }
 
-func (s *Scheduler) PullEvent() types.Event {
-	e := gEventQueue.Front()
+// runTask runs t until it completes, is cancelled or its timeout expires,
+// then reports a single terminal status.
+func (s *Scheduler) runTask(ctx context.Context, t *QueuedTask) {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Minute*time.Duration(t.Timeout))
+		defer cancel()
+	}
+
+	start := time.Now()
 
-	gEventQueue.Remove(e)
+	out, err := s.logs.Create(t.Id)
+	if err != nil {
+		s.finishTask(t, start, types.TaskFailed, err)
+		return
+	}
+
+	stopUpload, uploaded := make(chan struct{}), make(chan struct{})
+	go s.streamTaskLog(t, stopUpload, uploaded)
+
+	fmt.Fprintf(out, "==> %s task %s, attempt %d, started at %s\n", t.Type, t.Id, t.Attempts, start.UTC().Format(time.RFC3339))
+
+	switch t.Type {
+	case types.BuildTask:
+		err = s.DoBuildTask(ctx, t.Config, out)
+	case types.DeployTask:
+		err = s.DoDeployTask(ctx, t.Config, out)
+	default:
+		err = fmt.Errorf("unknown task type %q", t.Type)
+	}
+
+	status := taskStatus(ctx, err)
+	switch status {
+	case types.TaskTimedOut:
+		err = fmt.Errorf("timed out after %d minute(s): %w", t.Timeout, err)
+	case TaskCancelled:
+		err = fmt.Errorf("%w: %w", context.Cause(ctx), err)
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "==> %s: %v\n", status, err)
+	} else {
+		fmt.Fprintf(out, "==> %s in %s\n", status, time.Since(start).Round(time.Second))
+	}
+	out.Close()
 
-	return e.Value.(types.Event)
+	// The log is uploaded before the status so that it is complete once the
+	// control plane sees the task end.
+	close(stopUpload)
+	<-uploaded
+
+	s.finishTask(t, start, status, err)
+}
+
+// finishTask reports the terminal status of a task, records it in the audit
+// log and the task history and removes it from the queue.
+func (s *Scheduler) finishTask(t *QueuedTask, start time.Time, status string, err error) {
+	entry := t.Audit
+	entry.Time, entry.DurationMs, entry.Result = start, time.Since(start).Milliseconds(), AuditResultSuccess
+
+	if err != nil {
+		log.Println(err)
+		entry.Result, entry.Error = AuditResultFailure, err.Error()
+	}
+
+	s.ProcessPostTask(t.PipelineId, t.TaskId, status)
+	s.history.Finish(t.Id, status, entry.Error)
+
+	if err := s.audit.Record(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+
+	if err := s.queue.Done(t); err != nil {
+		log.Printf("Error removing task %s from the queue: %v", t.Id, err)
+	}
 }
 
+// updateTaskStatus queues a status update in the outbox, which delivers it
+// even if the control plane is unreachable for a while or the agent restarts.
 func (s *Scheduler) updateTaskStatus(pipelineId, taskId types.ObjectId, status string) {
-	body, _ := json.Marshal(types.UpdateTaskStatusInput{
+	err := s.outbox.Send("PUT", "/taskStatus", types.UpdateTaskStatusInput{
 		PipelineId: pipelineId,
 		TaskId:     taskId,
 		Task:       struct{ Status string }{Status: status}})
 
-	req, _ := http.NewRequest("PUT", s.cfg.ApiBaseUrl+"/taskStatus", bytes.NewReader(body))
-	req.Header.Set("X-Api-Key", s.cfg.ApiKey)
-	http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error queuing status %s of task %s: %v", status, taskId.Hex(), err)
+	}
 }
 
 func (s *Scheduler) ProcessPostTask(pipelineId, taskId types.ObjectId, status string) {
-	body, _ := json.Marshal(types.UpdateTaskStatusInput{
-		PipelineId: pipelineId,
-		TaskId:     taskId,
-		Task:       struct{ Status string }{Status: status}})
-
-	req, _ := http.NewRequest("PUT", s.cfg.ApiBaseUrl+"/taskStatus", bytes.NewReader(body))
-	req.Header.Set("X-Api-Key", s.cfg.ApiKey)
-	http.DefaultClient.Do(req)
+	s.updateTaskStatus(pipelineId, taskId, status)
 }
 
 func (s *Scheduler) StreamWebhookHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		body, _ := io.ReadAll(ctx.Request.Body)
+		if s.draining.Load() {
+			ctx.JSON(http.StatusServiceUnavailable, types.WebhookResponse{Msg: ErrShuttingDown.Error(), Code: types.CodeServerError})
+			return
+		}
+
+		body, err := io.ReadAll(ctx.Request.Body)
+
+		if err != nil {
+			ctx.JSON(bodyErrorStatus(err), types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
 
 		var sw types.StreamWebhook
-		json.Unmarshal(body, &sw)
+		err = json.Unmarshal(body, &sw)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
 
 		log.Println(sw.Payload)
 
-		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/task?pid=%s&id=%s", s.cfg.ApiBaseUrl, sw.Payload.PipelineId.Hex(), sw.Payload.TaskId.Hex()), nil)
-		req.Header.Set("X-Api-Key", s.cfg.ApiKey)
+		// A webhook delivered again is answered with the status of the task
+		// it already started.
+		if t, ok := s.history.Duplicate(queuedTaskId(sw.Payload.PipelineId, sw.Payload.TaskId)); ok {
+			s.duplicateTask(ctx, t)
+			return
+		}
+
+		var tRes types.GetTaskResponse
+		err = s.api.Do(ctx, "GET", fmt.Sprintf("/task?pid=%s&id=%s", sw.Payload.PipelineId.Hex(), sw.Payload.TaskId.Hex()), nil, &tRes)
 
-		res, err := http.DefaultClient.Do(req)
+		if err == nil && (tRes.Payload.Task.Id == "" || tRes.Payload.Task.Type == "") {
+			err = fmt.Errorf("task %s not returned by the control plane", sw.Payload.TaskId.Hex())
+		}
 
 		if err != nil {
 			log.Println(err)
-			ctx.JSON(http.StatusBadRequest, types.WebhookResponse{Msg: err.Error(), Code: types.CodeServerError})
 
+			var apiErr *ApiError
+			if errors.As(err, &apiErr) && !apiErr.Temporary() {
+				ctx.JSON(http.StatusBadRequest, types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
+			} else {
+				ctx.JSON(http.StatusBadGateway, types.WebhookResponse{Msg: err.Error(), Code: types.CodeServerError})
+			}
 			return
 		}
 
-		if res.StatusCode != 200 {
-			log.Println(res.Body)
-			ctx.JSON(http.StatusBadRequest, types.WebhookResponse{Msg: types.MsgClientError, Code: types.CodeClientError})
+		task := tRes.Payload.Task
+
+		task.Config, err = resolveTaskConfig(task, sw.Payload.Arguments)
 
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
 			return
 		}
 
-		body, _ = io.ReadAll(res.Body)
+		if !authorizeTask(ctx, task.Type, task.Config) {
+			return
+		}
 
-		var tRes types.GetTaskResponse
-		json.Unmarshal(body, &tRes)
+		entry := AuditEntry{
+			RemoteAddr: ctx.ClientIP(),
+			Action:     "task " + task.Type,
+			Target:     taskTarget(task.Config),
+			Request:    summarizeConfig(s.redactor, normalizeConfig(task.Config)),
+		}
+		setAuditActor(&entry, PrincipalFrom(ctx))
 
-		task := tRes.Payload.Task
+		known, accepted, err := s.acceptTask(sw.Payload.PipelineId, task, sw.Payload.Arguments, entry)
 
-		var timer *time.Timer
-		if task.Timeout > 0 {
-			timer = s.cleanUp(time.Minute*time.Duration(task.Timeout), func() {
-				s.updateTaskStatus(sw.Payload.PipelineId, task.Id, types.TaskTimedOut)
-			})
+		if err != nil {
+			log.Println(err)
+			ctx.JSON(http.StatusInternalServerError, types.WebhookResponse{Msg: err.Error(), Code: types.CodeServerError})
+			return
+		}
+
+		if !accepted {
+			s.duplicateTask(ctx, known)
+			return
 		}
 
-		s.updateTaskStatus(sw.Payload.PipelineId, task.Id, types.TaskInProgress)
 		ctx.JSON(http.StatusOK, types.WebhookResponse{})
+	}
+}
 
-		go func() {
-			var err error
-			switch task.Type {
-			case types.BuildTask:
-				err = s.DoBuildTask(task.Config, sw.Payload.Arguments)
-			case types.DeployTask:
-				err = s.DoDeployTask(task.Config, sw.Payload.Arguments)
-			}
+// acceptTask reports a task received from the control plane in progress and
+// queues it, or reports it failed when it cannot be queued. A task already
+// known by its pipeline and task ids is not queued again; acceptTask returns
+// false with the known task instead.
+func (s *Scheduler) acceptTask(pipelineId types.ObjectId, task types.Task, arguments []string, entry AuditEntry) (TaskInfo, bool, error) {
+	t := &QueuedTask{
+		Id:         queuedTaskId(pipelineId, task.Id),
+		PipelineId: pipelineId,
+		TaskId:     task.Id,
+		Type:       task.Type,
+		Timeout:    task.Timeout,
+		Config:     task.Config,
+		Arguments:  arguments,
+		EnqueuedAt: time.Now().UTC(),
+		Audit:      entry,
+	}
 
-			if timer != nil {
-				timer.Stop()
-			}
+	// Claiming the id makes concurrent deliveries of the same task start it
+	// once.
+	known, claimed, err := s.history.Claim(newTaskInfo(t, TaskStateQueued))
+	if err != nil || !claimed {
+		return known, false, err
+	}
 
-			if err != nil {
-				log.Println(err)
-				s.ProcessPostTask(sw.Payload.PipelineId, task.Id, types.TaskFailed)
-			} else {
-				s.ProcessPostTask(sw.Payload.PipelineId, task.Id, types.TaskDone)
-			}
-		}()
+	// The outbox delivers in order, so InProgress is queued before a worker
+	// can report the terminal status of the task.
+	s.updateTaskStatus(pipelineId, task.Id, types.TaskInProgress)
+
+	if err := s.queue.Push(t); err != nil {
+		s.history.Release(t.Id)
+		s.updateTaskStatus(pipelineId, task.Id, types.TaskFailed)
+		return TaskInfo{}, false, err
 	}
+
+	return known, true, nil
+}
+
+// duplicateTask answers a webhook for a task already started with its status,
+// without running it again.
+func (s *Scheduler) duplicateTask(ctx *gin.Context, t TaskInfo) {
+	log.Printf("Ignoring duplicate webhook for task %s (%s)", t.Id, t.Status)
+	ctx.JSON(http.StatusOK, types.WebhookResponse{Msg: t.Status})
 }
 
-func (s *Scheduler) DoDeployTask(conf interface{}, arguments []string) error {
+func (s *Scheduler) DoDeployTask(ctx context.Context, conf interface{}, out io.Writer) error {
 	var c model.DeployConfig
 
-	bs, err := json.Marshal(conf)
+	err := decodeConfig(conf, &c)
 
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(bs, &c)
+	return s.deploy(ctx, &c, out)
+}
 
-	if err != nil {
+// deploy replaces the container of c.ServiceName and waits until it is ready
+// as requested by c.WaitHealthy and c.MinUptime.
+func (s *Scheduler) deploy(ctx context.Context, c *model.DeployConfig, out io.Writer) error {
+	if err := s.cHelper.StartContainer(ctx, c, out); err != nil {
 		return err
 	}
 
-	if c.Files != nil {
-		for name, content := range c.Files {
-			err = util.WriteToFile(name, content)
-			if err != nil {
-				return err
-			}
-		}
+	if !c.WaitHealthy && c.MinUptime <= 0 {
+		return nil
 	}
 
-	if c.VolumeMounts != nil {
-		for srcDir := range c.VolumeMounts {
-			err = util.CreateDirsIfNotExist(srcDir)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	go func() {
-		s.cHelper.StartContainer(&c)
-	}()
-
-	return nil
+	return s.cHelper.WaitContainerReady(ctx, c.ServiceName, c.WaitHealthy, time.Duration(c.MinUptime)*time.Second)
 }
 
-func (s *Scheduler) DoBuildTask(conf interface{}, arguments []string) error {
+func (s *Scheduler) DoBuildTask(ctx context.Context, conf interface{}, out io.Writer) error {
 	var c model.BuildConfig
 
-	bs, err := json.Marshal(conf)
-
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(bs, &c)
+	err := decodeConfig(conf, &c)
 
 	if err != nil {
 		return err
@@ -204,11 +467,25 @@ func (s *Scheduler) DoBuildTask(conf interface{}, arguments []string) error {
 		c.RepoBranch = "main"
 	}
 
+	// The checkout is removed before cloning, so it must stay inside the
+	// build directory whatever the repository and branch names.
+	dir := filepath.Join(buildDir, c.RepoName+"_"+c.RepoBranch)
+	if !strings.HasPrefix(dir, buildDir+string(filepath.Separator)) {
+		return fmt.Errorf("repository %q and branch %q escape %s", c.RepoName, c.RepoBranch, buildDir)
+	}
+
 	// !!! Never omit the trailing slash, otherwise util.TarFiles will fail
-	path := "/var/temp/" + c.RepoName + "_" + c.RepoBranch + "/"
+	path := dir + "/"
 
 	os.RemoveAll(path)
-	err = util.CloneRepo(path, c.RepoUrl, c.RepoBranch, util.GitCredentials{Username: s.cfg.RepoUsername, Password: s.cfg.RepoPassword})
+
+	defer func() {
+		if ctx.Err() != nil {
+			os.RemoveAll(path)
+		}
+	}()
+
+	err = util.CloneRepo(ctx, path, c.RepoUrl, c.RepoBranch, util.GitCredentials{Username: s.cfg.RepoUsername, Password: s.cfg.RepoPassword}, out)
 
 	if err != nil {
 		return err
@@ -222,24 +499,53 @@ func (s *Scheduler) DoBuildTask(conf interface{}, arguments []string) error {
 
 	imageNameTag := c.ImageName + ":" + c.ImageTag
 
-	err = s.cHelper.BuildImage(files, &dTypes.ImageBuildOptions{Dockerfile: c.Dockerfile, Tags: []string{imageNameTag}, BuildArgs: c.Args, Version: dTypes.BuilderBuildKit})
+	imageId, err := s.cHelper.BuildImage(ctx, files, &dTypes.ImageBuildOptions{Dockerfile: c.Dockerfile, Tags: []string{imageNameTag}, BuildArgs: c.Args, Version: dTypes.BuilderBuildKit}, out)
 
 	if err != nil {
-		return err
+		return fmt.Errorf("build %s: %w", imageNameTag, err)
 	}
 
-	s.cHelper.PushImage(imageNameTag)
+	digest, err := s.cHelper.PushImage(ctx, imageNameTag, out)
+
+	if err != nil {
+		return fmt.Errorf("push %s: %w", imageNameTag, err)
+	}
+
+	fmt.Fprintf(out, "Built %s as %s, pushed %s\n", imageNameTag, imageId, digest)
 
 	return nil
 }
 
-func (s *Scheduler) cleanUp(delay time.Duration, job func()) *time.Timer {
-	t := time.NewTimer(delay)
-	go func() {
-		for range t.C {
-			job()
-		}
-	}()
+// decodeConfig converts a task config of unknown shape into v by round-tripping
+// it through JSON.
+func decodeConfig(conf interface{}, v interface{}) error {
+	bs, err := json.Marshal(conf)
 
-	return t
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bs, v)
+}
+
+// normalizeConfig converts a task config into plain decoded JSON values.
+func normalizeConfig(conf interface{}) interface{} {
+	var v interface{}
+	decodeConfig(conf, &v)
+	return v
+}
+
+// taskTarget names what a task acts on: the service of a deploy task or the
+// image of a build task.
+func taskTarget(conf interface{}) string {
+	var c struct {
+		ServiceName string `json:"serviceName"`
+		ImageName   string `json:"imageName"`
+	}
+	decodeConfig(conf, &c)
+
+	if c.ServiceName != "" {
+		return c.ServiceName
+	}
+	return c.ImageName
 }
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRunTaskTimeout(t *testing.T) {
+	aborted := make(chan struct{})
+	s, statuses := newTestScheduler(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	})
+
+	// The task is run here rather than by a worker; only the outbox runs.
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	s.stopOutbox = stopOutbox
+	go s.outbox.Run(outboxCtx)
+
+	id := queueDeploy(t, s, "a")
+	task, _ := s.queue.Get(id)
+	task.Timeout = 1
+
+	// The deadline of the task's context stands in for its timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s.runTask(ctx, task)
+
+	// The pull in progress is aborted on the Docker side.
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("image pull not cancelled")
+	}
+
+	ti, _ := s.history.Get(id)
+	if ti.Status != types.TaskTimedOut || !strings.Contains(ti.Error, "timed out after 1 minute(s)") {
+		t.Fatalf("got %s (%s), want timed out", ti.Status, ti.Error)
+	}
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := s.outbox.Flush(flushCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	// InProgress is reported when the task is queued, then exactly one
+	// terminal status.
+	var got []string
+	for _, in := range statuses() {
+		if in.TaskId == task.TaskId {
+			got = append(got, in.Task.Status)
+		}
+	}
+	if len(got) != 2 || got[0] != types.TaskInProgress || got[1] != types.TaskTimedOut {
+		t.Fatalf("statuses %v, want [%s %s]", got, types.TaskInProgress, types.TaskTimedOut)
+	}
+}
+
+func TestDoBuildTaskCheckoutPath(t *testing.T) {
+	s := &Scheduler{}
+
+	// The checkout, removed before cloning, must stay in the build directory.
+	for _, c := range []map[string]interface{}{
+		{"repoName": "../../home/deploy/app", "repoBranch": "main"},
+		{"repoName": "app", "repoBranch": "main/../../../../home/deploy"},
+	} {
+		err := s.DoBuildTask(context.Background(), c, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "escape "+buildDir) {
+			t.Errorf("%v: got %v, want the path refused", c, err)
+		}
+	}
+}
+
+func TestStreamWebhookScopedToken(t *testing.T) {
+	tasks := map[string]types.Task{}
+
+	controlPlane := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res types.GetTaskResponse
+		res.Payload.Task = tasks[r.URL.Query().Get("id")]
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer controlPlane.Close()
+
+	dir := t.TempDir()
+	s, err := NewScheduler(SchedulerConfig{ApiBaseUrl: controlPlane.URL, DataDir: dir, HostPathAllowlist: []string{dir}, DockerHost: "tcp://127.0.0.1:1", ApiTimeout: time.Second, TaskHistoryRetention: time.Hour, TaskDedupWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := gin.New()
+	g.POST("/streamWebhook", func(ctx *gin.Context) {
+		if services := ctx.GetHeader("X-Services"); services != "" {
+			ctx.Set(principalKey, &Principal{Role: RoleOperator, Services: strings.Split(services, ",")})
+		}
+	}, s.StreamWebhookHandler())
+
+	trigger := func(services string, task types.Task) int {
+		tasks[task.Id.Hex()] = task
+
+		var sw types.StreamWebhook
+		sw.Payload.PipelineId, sw.Payload.TaskId = bson.NewObjectId(), task.Id
+		body, _ := json.Marshal(sw)
+
+		req := httptest.NewRequest(http.MethodPost, "/streamWebhook", bytes.NewReader(body))
+		req.Header.Set("X-Services", services)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	build := func() types.Task {
+		return types.Task{Id: bson.NewObjectId(), Type: types.BuildTask, Config: map[string]interface{}{"imageName": "web", "repoUrl": "https://example.com/web.git"}}
+	}
+	deploy := func(service string) types.Task {
+		return types.Task{Id: bson.NewObjectId(), Type: types.DeployTask, Config: map[string]interface{}{"imageName": "app", "serviceName": service}}
+	}
+
+	for _, c := range []struct {
+		services string
+		task     types.Task
+		want     int
+	}{
+		{"web", build(), http.StatusForbidden},
+		{"web", deploy("web"), http.StatusOK},
+		{"web", deploy("db"), http.StatusForbidden},
+		{"web", deploy(""), http.StatusForbidden},
+		{"", build(), http.StatusOK},
+	} {
+		if code := trigger(c.services, c.task); code != c.want {
+			t.Errorf("%s task %v with services %q: got %d, want %d", c.task.Type, c.task.Config, c.services, code, c.want)
+		}
+	}
+}
+
+func TestDeployWaitsForReadiness(t *testing.T) {
+	var mu sync.Mutex
+	inspected := 0
+
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_ping":
+			w.Header().Set("Api-Version", "1.45")
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			w.Write([]byte(`{"status":"Pulled"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"web"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/web/json"):
+			mu.Lock()
+			inspected++
+			mu.Unlock()
+			w.Write([]byte(`{"Id":"web","Name":"/web","State":{"Status":"running","Running":true}}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer docker.Close()
+
+	dir := t.TempDir()
+	s, err := NewScheduler(SchedulerConfig{DataDir: dir, HostPathAllowlist: []string{dir}, DockerHost: "tcp://" + strings.TrimPrefix(docker.URL, "http://"), ApiTimeout: time.Second, TaskHistoryRetention: time.Hour, TaskDedupWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a readiness requirement the container is not inspected.
+	err = s.deploy(context.Background(), &model.DeployConfig{ServiceName: "web", ImageName: "app", ImageTag: "1"}, io.Discard)
+	mu.Lock()
+	n := inspected
+	mu.Unlock()
+	if err != nil || n != 0 {
+		t.Fatalf("got %v after %d inspections, want none", err, n)
+	}
+
+	// A healthy wait fails for an image without a healthcheck.
+	err = s.deploy(context.Background(), &model.DeployConfig{ServiceName: "web", ImageName: "app", ImageTag: "1", WaitHealthy: true}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "has no healthcheck") {
+		t.Fatalf("got %v, want the missing healthcheck", err)
+	}
+
+	// The minimum uptime is waited for until the deploy is cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.deploy(ctx, &model.DeployConfig{ServiceName: "web", ImageName: "app", ImageTag: "1", MinUptime: 3600}, io.Discard)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+var ErrShuttingDown = errors.New("agent is shutting down")
+
+// Drain stops the agent from accepting tasks and waits for the running ones to
+// finish. The tasks still running when ctx is done are cancelled and report
+// TaskCancelled. Queued tasks stay on disk and run on the next start.
+func (s *Scheduler) Drain(ctx context.Context) {
+	s.draining.Store(true)
+	s.queue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	s.abort()
+	if n := s.queue.CancelRunning(ErrShuttingDown); n > 0 {
+		log.Printf("Cancelling %d running task(s)", n)
+	}
+	<-done
+}
+
+// Flush waits for the status updates still in the outbox to be delivered,
+// until ctx is done, then stops delivering them. Those left are sent after a
+// restart.
+func (s *Scheduler) Flush(ctx context.Context) error {
+	err := s.outbox.Flush(ctx)
+
+	if s.stopOutbox != nil {
+		s.stopOutbox()
+	}
+
+	return err
+}
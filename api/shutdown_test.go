@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// blockingPull answers image pulls with an error once release is closed.
+func blockingPull(release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message":"pull failed"}`))
+	}
+}
+
+// newTestScheduler returns a scheduler with one worker, talking to a fake
+// Docker daemon whose image pulls are answered by pull and to a control plane
+// that records the task statuses it receives.
+func newTestScheduler(t *testing.T, pull http.HandlerFunc) (*Scheduler, func() []types.UpdateTaskStatusInput) {
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_ping":
+			w.Header().Set("Api-Version", "1.45")
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			pull(w, r)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message":"not implemented"}`))
+		}
+	}))
+	t.Cleanup(docker.Close)
+
+	var mu sync.Mutex
+	var statuses []types.UpdateTaskStatusInput
+
+	controlPlane := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/taskStatus" {
+			var in types.UpdateTaskStatusInput
+			json.NewDecoder(r.Body).Decode(&in)
+
+			mu.Lock()
+			statuses = append(statuses, in)
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"code":0}`))
+	}))
+	t.Cleanup(controlPlane.Close)
+
+	dir := t.TempDir()
+	s, err := NewScheduler(SchedulerConfig{
+		ApiBaseUrl:           controlPlane.URL,
+		DockerHost:           "tcp://" + strings.TrimPrefix(docker.URL, "http://"),
+		HostPathAllowlist:    []string{dir},
+		DataDir:              dir,
+		AuditMaxSize:         1 << 20,
+		AuditMaxFiles:        1,
+		TaskWorkers:          1,
+		DeployConcurrency:    2,
+		TaskHistoryRetention: time.Hour,
+		TaskDedupWindow:      time.Minute,
+		ApiTimeout:           time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop delivering statuses before the control plane goes away.
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Flush(ctx)
+	})
+
+	return s, func() []types.UpdateTaskStatusInput {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]types.UpdateTaskStatusInput(nil), statuses...)
+	}
+}
+
+func queueDeploy(t *testing.T, s *Scheduler, service string) string {
+	pid, tid := bson.NewObjectId(), bson.NewObjectId()
+	task := types.Task{Id: tid, Type: types.DeployTask, Config: map[string]interface{}{"imageName": "app", "imageTag": "1", "serviceName": service}}
+
+	if _, accepted, err := s.acceptTask(pid, task, nil, AuditEntry{}); err != nil || !accepted {
+		t.Fatalf("queue %s: accepted %v, err %v", service, accepted, err)
+	}
+	return queuedTaskId(pid, tid)
+}
+
+// waitRunning waits for the task id to be picked up by a worker.
+func waitRunning(t *testing.T, s *Scheduler, id string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, ti := range s.queue.Tasks() {
+			if ti.Id == id && ti.State == TaskStateRunning {
+				return
+			}
+		}
+	}
+	t.Fatalf("task %s not started", id)
+}
+
+func TestDrainWaitsForRunningTasks(t *testing.T) {
+	release := make(chan struct{})
+	s, _ := newTestScheduler(t, blockingPull(release))
+
+	running, queued := queueDeploy(t, s, "a"), queueDeploy(t, s, "b")
+	s.StartWorkers()
+	waitRunning(t, s, running)
+
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Drain(ctx)
+
+	if ctx.Err() != nil {
+		t.Fatal("drain waited for its deadline")
+	}
+
+	// The running task ends on its own rather than being cancelled.
+	if ti, _ := s.history.Get(running); ti.State != TaskStateFinished || ti.Status != types.TaskFailed {
+		t.Fatalf("running task: got %s/%s, want finished with its own status", ti.State, ti.Status)
+	}
+
+	// The queued task is not started and is loaded again on the next start.
+	if ti, _ := s.history.Get(queued); ti.State == TaskStateFinished {
+		t.Fatal("queued task was run or reported")
+	}
+
+	q, _, err := NewTaskQueue(filepath.Join(s.cfg.DataDir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.Get(queued); !ok || q.Len() != 1 {
+		t.Fatalf("got %d queued tasks after restart, want the queued one", q.Len())
+	}
+
+	// Webhooks are refused while draining.
+	g := gin.New()
+	g.POST("/streamWebhook", s.StreamWebhookHandler())
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/streamWebhook", strings.NewReader(`{}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("webhook while draining: got %d, want 503", w.Code)
+	}
+}
+
+func TestDrainCancelsAtDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, _ := newTestScheduler(t, blockingPull(release))
+
+	running := queueDeploy(t, s, "a")
+	s.StartWorkers()
+	waitRunning(t, s, running)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	s.Drain(ctx)
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("drain took %s after its deadline", elapsed)
+	}
+
+	// The task is cancelled and reports a single terminal status.
+	ti, _ := s.history.Get(running)
+	if ti.State != TaskStateFinished || ti.Status != TaskCancelled || !strings.Contains(ti.Error, ErrShuttingDown.Error()) {
+		t.Fatalf("got %s/%s (%s), want cancelled by the shutdown", ti.State, ti.Status, ti.Error)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+var (
+	ErrArgumentNotAllowed = errors.New("only imageTag, repoBranch, args.NAME and env.NAME can be overridden")
+	ErrInvalidArgument    = errors.New("invalid argument value")
+)
+
+// imageTagPattern is the tag grammar of Docker image references.
+var imageTagPattern = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// applyArguments overrides fields of the task config v, a *model.BuildConfig
+// or a *model.DeployConfig, with arguments of the form key=value: imageTag and
+// repoBranch, a build argument with args.NAME or an environment variable with
+// env.NAME. Other fields, such as the repository or the host paths, only come
+// from the pipeline. imageTag must be a valid Docker tag and repoBranch a valid
+// branch name. Arguments not of the form key=value are ignored.
+func applyArguments(v interface{}, arguments []string) error {
+	for _, arg := range arguments {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			log.Printf("Ignoring argument %q, not of the form key=value", arg)
+			continue
+		}
+
+		if err := validateArgument(key, value); err != nil {
+			return fmt.Errorf("invalid argument %q: %w", arg, err)
+		}
+
+		name, sub, _ := strings.Cut(key, ".")
+
+		allowed := true
+		switch c := v.(type) {
+		case *model.BuildConfig:
+			switch {
+			case key == "imageTag":
+				c.ImageTag = value
+			case key == "repoBranch":
+				c.RepoBranch = value
+			case name == "args" && sub != "":
+				if c.Args == nil {
+					c.Args = map[string]*string{}
+				}
+				c.Args[sub] = &value
+			default:
+				allowed = false
+			}
+		case *model.DeployConfig:
+			switch {
+			case key == "imageTag":
+				c.ImageTag = value
+			case name == "env" && sub != "":
+				c.Env = setEnv(c.Env, sub, value)
+			default:
+				allowed = false
+			}
+		default:
+			allowed = false
+		}
+
+		if !allowed {
+			return fmt.Errorf("invalid argument %q: %w", arg, ErrArgumentNotAllowed)
+		}
+	}
+
+	return nil
+}
+
+// validateArgument checks the values of the arguments that end up in image
+// references or host paths.
+func validateArgument(key, value string) error {
+	switch key {
+	case "imageTag":
+		if !imageTagPattern.MatchString(value) {
+			return fmt.Errorf("%w: %q is not a valid image tag", ErrInvalidArgument, value)
+		}
+	case "repoBranch":
+		if strings.Contains(value, "..") || plumbing.ReferenceName("refs/heads/"+value).Validate() != nil {
+			return fmt.Errorf("%w: %q is not a valid branch name", ErrInvalidArgument, value)
+		}
+	}
+
+	return nil
+}
+
+// setEnv sets the variable name of a list of NAME=VALUE entries.
+func setEnv(env []string, name, value string) []string {
+	for i, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			env[i] = name + "=" + value
+			return env
+		}
+	}
+	return append(env, name+"="+value)
+}
+
+// resolveTaskConfig returns the config of a task with its arguments applied.
+// It is resolved once, when the task is accepted, and queued as is.
+func resolveTaskConfig(task types.Task, arguments []string) (interface{}, error) {
+	if len(arguments) == 0 {
+		return task.Config, nil
+	}
+
+	var c interface{}
+	switch task.Type {
+	case types.BuildTask:
+		c = &model.BuildConfig{}
+	case types.DeployTask:
+		c = &model.DeployConfig{}
+	default:
+		return task.Config, nil
+	}
+
+	if err := decodeConfig(task.Config, c); err != nil {
+		return nil, err
+	}
+
+	if err := applyArguments(c, arguments); err != nil {
+		return nil, err
+	}
+
+	return normalizeConfig(c), nil
+}
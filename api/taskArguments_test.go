@@ -0,0 +1,75 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"deploybot-service-agent/model"
+)
+
+func TestApplyArguments(t *testing.T) {
+	c := model.DeployConfig{ImageName: "app", ImageTag: "1.0", Env: []string{"FOO=old", "BAR=1"}}
+
+	// Arguments not of the form key=value are ignored.
+	if err := applyArguments(&c, []string{"imageTag=1.4.2", "env.FOO=bar=baz", "env.NEW=x", "--verbose"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := model.DeployConfig{ImageName: "app", ImageTag: "1.4.2", Env: []string{"FOO=bar=baz", "BAR=1", "NEW=x"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("got %+v, want %+v", c, want)
+	}
+
+	var b model.BuildConfig
+	if err := applyArguments(&b, []string{"imageTag=2.0", "repoBranch=release", "args.NODE_VERSION=20", "args.A=1"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.ImageTag != "2.0" || b.RepoBranch != "release" || *b.Args["NODE_VERSION"] != "20" || *b.Args["A"] != "1" {
+		t.Fatalf("unexpected build config %+v", b)
+	}
+
+	denied := []struct {
+		config interface{}
+		arg    string
+	}{
+		{&model.BuildConfig{}, "repoUrl=https://evil.example/repo.git"},
+		{&model.BuildConfig{}, "imageName=other"},
+		{&model.BuildConfig{}, "args=x"},
+		{&model.BuildConfig{}, "env.FOO=bar"},
+		{&model.DeployConfig{}, "serviceName=other"},
+		{&model.DeployConfig{}, "volumeMounts./etc=/host"},
+		{&model.DeployConfig{}, "files./etc/passwd=x"},
+		{&model.DeployConfig{}, "repoBranch=release"},
+		{&model.DeployConfig{}, "env=FOO"},
+	}
+	for _, d := range denied {
+		if err := applyArguments(d.config, []string{d.arg}); !errors.Is(err, ErrArgumentNotAllowed) {
+			t.Errorf("%q: got %v, want ErrArgumentNotAllowed", d.arg, err)
+		}
+	}
+}
+
+func TestApplyArgumentsValidation(t *testing.T) {
+	for _, arg := range []string{
+		"repoBranch=main/../../../../home/deploy",
+		"repoBranch=../etc",
+		"repoBranch=a..b",
+		"repoBranch=/abs",
+		"repoBranch=",
+		"imageTag=../x",
+		"imageTag=1.0 latest",
+		"imageTag=.hidden",
+		"imageTag=",
+	} {
+		if err := applyArguments(&model.BuildConfig{}, []string{arg}); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%q: got %v, want ErrInvalidArgument", arg, err)
+		}
+	}
+
+	for _, arg := range []string{"repoBranch=feature/login-form", "repoBranch=release-1.4", "imageTag=1.4.2-rc_1", "imageTag=latest"} {
+		if err := applyArguments(&model.BuildConfig{}, []string{arg}); err != nil {
+			t.Errorf("%q: %v", arg, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"deploybot-service-agent/util"
+)
+
+const TaskStateFinished = "finished"
+
+// TaskHistory records every task accepted by the agent, keyed by pipeline and
+// task id, so that a webhook delivered twice does not run the task twice. A
+// task is only a duplicate while it is queued or running, or within the dedup
+// window after it finished; later, the same ids run the task again. Finished
+// tasks are forgotten, with their logs, after the retention period.
+type TaskHistory struct {
+	dir         string
+	retention   time.Duration
+	dedupWindow time.Duration
+
+	mu    sync.Mutex
+	tasks map[string]*TaskInfo
+}
+
+func NewTaskHistory(dir string, retention, dedupWindow time.Duration) (*TaskHistory, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	h := &TaskHistory{dir: dir, retention: retention, dedupWindow: dedupWindow, tasks: map[string]*TaskInfo{}}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		bs, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		var t TaskInfo
+		if err := json.Unmarshal(bs, &t); err != nil {
+			log.Printf("Skipping corrupt task record %s: %v", f, err)
+			continue
+		}
+		h.tasks[t.Id] = &t
+	}
+
+	h.mu.Lock()
+	h.prune(time.Now())
+	h.mu.Unlock()
+
+	return h, nil
+}
+
+func (h *TaskHistory) path(id string) string {
+	return filepath.Join(h.dir, id+".json")
+}
+
+func (h *TaskHistory) save(t *TaskInfo) error {
+	bs, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(h.path(t.Id), bs, 0600)
+}
+
+// isDuplicate reports whether a task with the id of t would duplicate t.
+func (h *TaskHistory) isDuplicate(t *TaskInfo, now time.Time) bool {
+	return t.State != TaskStateFinished || now.Sub(t.FinishedAt) < h.dedupWindow
+}
+
+// Duplicate returns the task id when a task with that id would duplicate it.
+func (h *TaskHistory) Duplicate(id string) (TaskInfo, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if t, ok := h.tasks[id]; ok && h.isDuplicate(t, time.Now()) {
+		return *t, true
+	}
+	return TaskInfo{}, false
+}
+
+// Claim records t unless it duplicates a known task, in which case the known
+// task is returned instead. The record and the log of an earlier run of t are
+// replaced.
+func (h *TaskHistory) Claim(t TaskInfo) (TaskInfo, bool, error) {
+	if strings.ContainsAny(t.Id, `/\`) {
+		return TaskInfo{}, false, os.ErrInvalid
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if known, ok := h.tasks[t.Id]; ok {
+		if h.isDuplicate(known, time.Now()) {
+			return *known, false, nil
+		}
+		os.Remove(filepath.Join(h.dir, t.Id+".log"))
+	}
+
+	if err := h.save(&t); err != nil {
+		return TaskInfo{}, false, err
+	}
+	h.tasks[t.Id] = &t
+
+	return t, true, nil
+}
+
+// Release forgets a claimed task that could not be queued, so that the
+// control plane can deliver it again.
+func (h *TaskHistory) Release(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.tasks, id)
+	os.Remove(h.path(id))
+}
+
+// ReleaseOrphans forgets the tasks that are neither finished nor queued, as
+// when the agent stopped between claiming a task and queuing it, so that the
+// control plane can deliver them again. It returns their ids.
+func (h *TaskHistory) ReleaseOrphans(queued func(id string) bool) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var ids []string
+	for id, t := range h.tasks {
+		if t.State != TaskStateFinished && !queued(id) {
+			delete(h.tasks, id)
+			os.Remove(h.path(id))
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Finish records the terminal status of a task.
+func (h *TaskHistory) Finish(id, status, errMsg string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.tasks[id]
+	if !ok {
+		return
+	}
+
+	t.State, t.Status, t.Error, t.FinishedAt = TaskStateFinished, status, errMsg, time.Now().UTC()
+	if err := h.save(t); err != nil {
+		log.Printf("Error saving task record %s: %v", id, err)
+	}
+
+	h.prune(time.Now())
+}
+
+func (h *TaskHistory) Get(id string) (TaskInfo, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.tasks[id]
+	if !ok {
+		return TaskInfo{}, false
+	}
+	return *t, true
+}
+
+// Finished returns the finished tasks, oldest first.
+func (h *TaskHistory) Finished() []TaskInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var res []TaskInfo
+	for _, t := range h.tasks {
+		if t.State == TaskStateFinished {
+			res = append(res, *t)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].FinishedAt.Before(res[j].FinishedAt) })
+
+	return res
+}
+
+// prune removes the records and logs of the tasks finished before the
+// retention period.
+func (h *TaskHistory) prune(now time.Time) {
+	for id, t := range h.tasks {
+		if t.State == TaskStateFinished && now.Sub(t.FinishedAt) > h.retention {
+			delete(h.tasks, id)
+			os.Remove(h.path(id))
+			os.Remove(filepath.Join(h.dir, id+".log"))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTaskHistoryDuplicates(t *testing.T) {
+	dir := t.TempDir()
+
+	h, err := NewTaskHistory(dir, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := queuedTaskId(bson.NewObjectId(), bson.NewObjectId())
+	if _, claimed, err := h.Claim(TaskInfo{Id: id, State: TaskStateQueued, Status: "InProgress"}); err != nil || !claimed {
+		t.Fatalf("first claim: claimed %v, err %v", claimed, err)
+	}
+
+	// A running task is a duplicate.
+	if _, claimed, _ := h.Claim(TaskInfo{Id: id, State: TaskStateQueued}); claimed {
+		t.Fatal("running task claimed twice")
+	}
+
+	h.Finish(id, "Done", "")
+
+	// The record survives a restart and blocks the same task within the
+	// dedup window.
+	if h, err = NewTaskHistory(dir, time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	known, claimed, err := h.Claim(TaskInfo{Id: id, State: TaskStateQueued})
+	if err != nil || claimed {
+		t.Fatalf("duplicate claim: claimed %v, err %v", claimed, err)
+	}
+	if known.State != TaskStateFinished || known.Status != "Done" {
+		t.Fatalf("got %s/%s, want the finished task", known.State, known.Status)
+	}
+
+	// Past the retention period, the record and the log are removed.
+	if err := os.WriteFile(filepath.Join(dir, id+".log"), []byte("done\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mu.Lock()
+	h.prune(time.Now().Add(2 * time.Hour))
+	h.mu.Unlock()
+
+	if _, ok := h.Get(id); ok {
+		t.Fatal("expired task still in the history")
+	}
+	if _, err := os.Stat(filepath.Join(dir, id+".log")); !os.IsNotExist(err) {
+		t.Fatalf("expired task log not removed: %v", err)
+	}
+}
+
+func TestTaskHistoryRerun(t *testing.T) {
+	dir := t.TempDir()
+
+	h, err := NewTaskHistory(dir, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := queuedTaskId(bson.NewObjectId(), bson.NewObjectId())
+	if _, claimed, err := h.Claim(TaskInfo{Id: id, State: TaskStateQueued, Attempts: 1}); err != nil || !claimed {
+		t.Fatalf("first run: claimed %v, err %v", claimed, err)
+	}
+	h.Finish(id, "Done", "")
+
+	if err := os.WriteFile(filepath.Join(dir, id+".log"), []byte("first run\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same pipeline task triggered again after the dedup window runs.
+	h.mu.Lock()
+	h.tasks[id].FinishedAt = time.Now().Add(-2 * time.Minute)
+	h.mu.Unlock()
+
+	if _, ok := h.Duplicate(id); ok {
+		t.Fatal("finished task still a duplicate after the dedup window")
+	}
+
+	rerun, claimed, err := h.Claim(TaskInfo{Id: id, State: TaskStateQueued})
+	if err != nil || !claimed {
+		t.Fatalf("re-run: claimed %v, err %v", claimed, err)
+	}
+	if rerun.State != TaskStateQueued {
+		t.Fatalf("got state %s, want the new run", rerun.State)
+	}
+	if _, err := os.Stat(filepath.Join(dir, id+".log")); !os.IsNotExist(err) {
+		t.Fatalf("log of the first run kept: %v", err)
+	}
+}
+
+func TestTaskHistoryOrphans(t *testing.T) {
+	dir := t.TempDir()
+	cfg := SchedulerConfig{DataDir: dir, HostPathAllowlist: []string{dir}, DockerHost: "tcp://127.0.0.1:1", TaskHistoryRetention: time.Hour, TaskDedupWindow: time.Hour}
+
+	s, err := NewScheduler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := bson.NewObjectId()
+	queued := types.Task{Id: bson.NewObjectId(), Type: types.DeployTask}
+	if _, accepted, err := s.acceptTask(pid, queued, nil, AuditEntry{}); err != nil || !accepted {
+		t.Fatalf("queue: accepted %v, err %v", accepted, err)
+	}
+
+	// The agent stops after claiming a task and before queuing it.
+	orphan := types.Task{Id: bson.NewObjectId(), Type: types.DeployTask}
+	if _, claimed, err := s.history.Claim(TaskInfo{Id: queuedTaskId(pid, orphan.Id), State: TaskStateQueued}); err != nil || !claimed {
+		t.Fatalf("claim: claimed %v, err %v", claimed, err)
+	}
+
+	if s, err = NewScheduler(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued task is still known, the orphan is accepted when delivered
+	// again.
+	if _, ok := s.history.Duplicate(queuedTaskId(pid, queued.Id)); !ok {
+		t.Fatal("queued task forgotten")
+	}
+	if _, accepted, err := s.acceptTask(pid, orphan, nil, AuditEntry{}); err != nil || !accepted {
+		t.Fatalf("redelivered orphan: accepted %v, err %v", accepted, err)
+	}
+}
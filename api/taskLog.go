@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	taskLogUploadInterval = 5 * time.Second
+	taskLogChunkSize      = 64 << 10
+)
+
+// TaskLogs keeps the output of every task, from the git progress to the
+// build steps and the image push or pull, in <dir>/<id>.log.
+type TaskLogs struct {
+	dir string
+
+	mu     sync.Mutex
+	active map[string]*TaskLog
+}
+
+func NewTaskLogs(dir string) (*TaskLogs, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &TaskLogs{dir: dir, active: map[string]*TaskLog{}}, nil
+}
+
+func (ls *TaskLogs) path(id string) string {
+	return filepath.Join(ls.dir, id+".log")
+}
+
+// Create opens the log of a task for writing. The output of a task run again
+// after a restart is appended.
+func (ls *TaskLogs) Create(id string) (*TaskLog, error) {
+	f, err := os.OpenFile(ls.path(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &TaskLog{logs: ls, id: id, file: f, changed: make(chan struct{})}
+
+	ls.mu.Lock()
+	ls.active[id] = l
+	ls.mu.Unlock()
+
+	return l, nil
+}
+
+// Copy writes the log of a task to w from offset. With follow set, it keeps
+// writing the output of a running task until the task ends or ctx is done.
+func (ls *TaskLogs) Copy(ctx context.Context, id string, offset int64, follow bool, w io.Writer, flush func()) error {
+	f, err := os.Open(ls.path(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	for {
+		ls.mu.Lock()
+		l := ls.active[id]
+		ls.mu.Unlock()
+
+		// The state is taken before copying so that no write is missed.
+		var changed <-chan struct{}
+		if l != nil {
+			changed = l.wait()
+		}
+
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		flush()
+
+		if !follow || changed == nil {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// TaskLog is the log of a running task.
+type TaskLog struct {
+	logs *TaskLogs
+	id   string
+	file *os.File
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+func (l *TaskLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n, err := l.file.Write(p)
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	return n, err
+}
+
+// wait returns a channel closed on the next write or when the log is closed.
+func (l *TaskLog) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.changed
+}
+
+func (l *TaskLog) Close() error {
+	l.logs.mu.Lock()
+	delete(l.logs.active, l.id)
+	l.logs.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	return l.file.Close()
+}
+
+// uploadTaskLog sends the log of t to the control plane from offset, in chunks
+// of at most taskLogChunkSize bytes, until ctx is done, and returns the offset
+// reached. Chunks end on a whole UTF-8 character; a character not written
+// completely yet is left for the next upload unless final is set.
+func (s *Scheduler) uploadTaskLog(ctx context.Context, t *QueuedTask, offset int64, final bool) int64 {
+	f, err := os.Open(s.logs.path(t.Id))
+	if err != nil {
+		return offset
+	}
+	defer f.Close()
+
+	buf := make([]byte, taskLogChunkSize)
+	for {
+		n, err := f.ReadAt(buf, offset)
+		if n == 0 {
+			if err != nil && err != io.EOF {
+				log.Printf("Error reading the log of task %s: %v", t.Id, err)
+			}
+			return offset
+		}
+
+		if n == len(buf) || !final {
+			if n = completeRunes(buf[:n]); n == 0 {
+				return offset
+			}
+		}
+
+		err = s.api.Do(ctx, "POST", "/taskLog", model.TaskLogChunk{PipelineId: t.PipelineId.Hex(), TaskId: t.TaskId.Hex(), Offset: offset, Content: string(buf[:n])}, nil)
+
+		if err != nil {
+			log.Printf("Error uploading the log of task %s: %v", t.Id, err)
+			return offset
+		}
+
+		offset += int64(n)
+	}
+}
+
+// completeRunes returns the length of the longest prefix of p that does not end
+// in the middle of a UTF-8 character.
+func completeRunes(p []byte) int {
+	n := len(p)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return n
+}
+
+// streamTaskLog uploads the log of t every taskLogUploadInterval until stop
+// is closed, then uploads the rest and closes done. Each upload takes at most
+// ApiTimeout, and none is waited for once the agent stops draining.
+func (s *Scheduler) streamTaskLog(t *QueuedTask, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	if !s.cfg.TaskLogUpload {
+		return
+	}
+
+	ticker := time.NewTicker(taskLogUploadInterval)
+	defer ticker.Stop()
+
+	upload := func(offset int64, final bool) int64 {
+		ctx, cancel := context.WithTimeout(s.abortCtx, s.cfg.ApiTimeout)
+		defer cancel()
+		return s.uploadTaskLog(ctx, t, offset, final)
+	}
+
+	var offset int64
+	for {
+		select {
+		case <-ticker.C:
+			offset = upload(offset, false)
+		case <-stop:
+			upload(offset, true)
+			return
+		}
+	}
+}
+
+func (s *Scheduler) GetTaskLog() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.Param("id")
+
+		// The service of a task no longer in the history is unknown, so only
+		// callers allowed every service may read its log.
+		if t, ok := s.findTask(id); ok {
+			if t.Service != "" && !authorizeService(ctx, t.Service) {
+				return
+			}
+		} else if p := PrincipalFrom(ctx); p != nil && len(p.Services) > 0 {
+			abortForbidden(ctx, fmt.Errorf("%w: task %s", ErrServiceNotPermitted, id))
+			return
+		}
+
+		var offset int64
+		if v := ctx.Query("offset"); v != "" {
+			if _, err := fmt.Sscan(v, &offset); err != nil || offset < 0 {
+				ctx.JSON(http.StatusBadRequest, model.ApiResponse{Msg: "invalid offset", Code: types.CodeClientError})
+				return
+			}
+		}
+
+		if _, err := os.Stat(s.logs.path(id)); err != nil {
+			ctx.JSON(http.StatusNotFound, model.ApiResponse{Msg: ErrTaskNotFound.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		ctx.Header("Content-Type", "text/plain; charset=utf-8")
+		ctx.Status(http.StatusOK)
+
+		err := s.logs.Copy(ctx.Request.Context(), id, offset, ctx.Query("follow") == "true", ctx.Writer, ctx.Writer.Flush)
+		if err != nil {
+			log.Printf("Error streaming the log of task %s: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"deploybot-service-agent/model"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTaskLogFollow(t *testing.T) {
+	logs, err := NewTaskLogs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := logs.Create("task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("cloning\n"))
+
+	var out syncBuffer
+	done := make(chan error)
+	go func() {
+		done <- logs.Copy(context.Background(), "task", 0, true, &out, func() {})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	l.Write([]byte("building\n"))
+	l.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("follow did not end with the task")
+	}
+
+	if out.String() != "cloning\nbuilding\n" {
+		t.Fatalf("got %q", out.String())
+	}
+
+	var rest bytes.Buffer
+	if err := logs.Copy(context.Background(), "task", 8, true, &rest, func() {}); err != nil || rest.String() != "building\n" {
+		t.Fatalf("got %q, %v from offset 8", rest.String(), err)
+	}
+}
+
+func TestUploadTaskLog(t *testing.T) {
+	var mu sync.Mutex
+	var chunks []model.TaskLogChunk
+	hang := false
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := hang
+		mu.Unlock()
+
+		if h {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+
+		var c model.TaskLogChunk
+		json.NewDecoder(r.Body).Decode(&c)
+
+		mu.Lock()
+		chunks = append(chunks, c)
+		mu.Unlock()
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	logs, err := NewTaskLogs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scheduler{logs: logs, api: NewControlPlaneClient(srv.URL, "key", time.Second, 5)}
+	task := &QueuedTask{Id: "task", PipelineId: bson.NewObjectId(), TaskId: bson.NewObjectId()}
+
+	// The 64 KiB chunk boundary falls inside "é", and the log ends in the
+	// middle of "€" while it is being written.
+	content := strings.Repeat("a", taskLogChunkSize-1) + "é€"
+	if err := os.WriteFile(logs.path(task.Id), []byte(content[:len(content)-1]), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	offset := s.uploadTaskLog(context.Background(), task, 0, false)
+	if offset != int64(taskLogChunkSize+1) {
+		t.Fatalf("got offset %d, want the partial character left out", offset)
+	}
+
+	if err := os.WriteFile(logs.path(task.Id), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if offset = s.uploadTaskLog(context.Background(), task, offset, true); offset != int64(len(content)) {
+		t.Fatalf("got offset %d, want %d", offset, len(content))
+	}
+
+	var got strings.Builder
+	for _, c := range chunks {
+		if !utf8.ValidString(c.Content) {
+			t.Fatalf("chunk at %d is not valid UTF-8", c.Offset)
+		}
+		got.WriteString(c.Content)
+	}
+	if got.String() != content {
+		t.Fatal("uploaded chunks do not add up to the log")
+	}
+
+	// An unreachable API holds an upload no longer than its context.
+	mu.Lock()
+	hang = true
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if offset := s.uploadTaskLog(ctx, task, 0, true); offset != 0 {
+		t.Fatalf("got offset %d, want nothing uploaded", offset)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("upload took %s", elapsed)
+	}
+}
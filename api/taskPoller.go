@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+)
+
+const (
+	AgentModeWebhook = "webhook"
+	AgentModePull    = "pull"
+)
+
+const (
+	pollRetryBase = time.Second
+	pollRetryMax  = time.Minute
+
+	// pollBusyDelay is how long the poller waits before checking again when
+	// the queue already holds a task for every worker.
+	pollBusyDelay = time.Second
+)
+
+// AssignedTask is a task assigned to the agent by the control plane, as
+// returned by a poll.
+type AssignedTask struct {
+	PipelineId types.ObjectId `json:"pipelineId"`
+	Arguments  []string       `json:"arguments"`
+	Task       types.Task     `json:"task"`
+}
+
+type claimTaskInput struct {
+	AgentId    string         `json:"agentId"`
+	PipelineId types.ObjectId `json:"pipelineId"`
+	TaskId     types.ObjectId `json:"taskId"`
+}
+
+// PollTasks long-polls the control plane for the tasks assigned to the agent
+// until ctx is done. Each task is claimed, so that no other agent runs it, then
+// queued and run like a task received on the webhook.
+func (s *Scheduler) PollTasks(ctx context.Context) {
+	// A poll is held open by the control plane for up to PollWait, so it gets
+	// its own timeout and is retried by this loop rather than by the client.
+	client := NewControlPlaneClient(s.cfg.ApiBaseUrl, s.cfg.ApiKey, s.cfg.PollWait+s.cfg.ApiTimeout, 0)
+	path := fmt.Sprintf("/agent/tasks?agent=%s&wait=%d", url.QueryEscape(s.cfg.AgentId), int(s.cfg.PollWait.Seconds()))
+
+	log.Printf("Polling %s for tasks as agent %s", s.cfg.ApiBaseUrl, s.cfg.AgentId)
+
+	attempt := 0
+	for ctx.Err() == nil {
+		// Tasks are only taken when a worker can run them soon, leaving the
+		// others to the agents with free workers.
+		if s.queue.Len() >= max(s.cfg.TaskWorkers, 1) {
+			select {
+			case <-time.After(pollBusyDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		var res struct {
+			Payload []AssignedTask `json:"payload"`
+		}
+
+		if err := client.Do(ctx, "GET", path, nil, &res); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := backoff(attempt, pollRetryBase, pollRetryMax)
+			log.Printf("Error polling for tasks, retrying in %s: %v", delay.Round(time.Second), err)
+			attempt++
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		attempt = 0
+		queued := 0
+		for _, a := range res.Payload {
+			if s.claimTask(ctx, a) {
+				queued++
+			}
+		}
+
+		// A control plane answering at once, or only with tasks that cannot
+		// be taken, is not polled again before PollInterval.
+		if queued == 0 {
+			select {
+			case <-time.After(s.cfg.PollInterval):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// claimTask claims a task assigned to the agent and queues it, and reports
+// whether it did. A task the control plane lets another agent claim is
+// skipped.
+func (s *Scheduler) claimTask(ctx context.Context, a AssignedTask) bool {
+	if a.Task.Id == "" || a.Task.Type == "" {
+		log.Printf("Skipping incomplete task assigned in pipeline %s", a.PipelineId.Hex())
+		return false
+	}
+
+	id := queuedTaskId(a.PipelineId, a.Task.Id)
+
+	err := s.api.Do(ctx, "POST", "/agent/tasks/claim", claimTaskInput{AgentId: s.cfg.AgentId, PipelineId: a.PipelineId, TaskId: a.Task.Id}, nil)
+	if err != nil {
+		log.Printf("Error claiming task %s: %v", id, err)
+		return false
+	}
+
+	// A task assigned again, e.g. when the answer to its claim was lost, is
+	// claimed again so that the control plane stops assigning it, but not run
+	// twice. The status of a finished one is reported again.
+	if known, ok := s.history.Duplicate(id); ok {
+		if known.State == TaskStateFinished {
+			s.updateTaskStatus(a.PipelineId, a.Task.Id, known.Status)
+		}
+		return false
+	}
+
+	// The task is claimed by this agent, so one that cannot be queued is
+	// reported failed rather than left to no one.
+	a.Task.Config, err = resolveTaskConfig(a.Task, a.Arguments)
+	if err != nil {
+		log.Printf("Error queuing task %s: %v", id, err)
+		s.updateTaskStatus(a.PipelineId, a.Task.Id, types.TaskFailed)
+		return false
+	}
+
+	entry := AuditEntry{
+		Actor:      "control plane",
+		AuthMethod: AgentModePull,
+		Action:     "task " + a.Task.Type,
+		Target:     taskTarget(a.Task.Config),
+		Request:    summarizeConfig(s.redactor, normalizeConfig(a.Task.Config)),
+	}
+
+	_, accepted, err := s.acceptTask(a.PipelineId, a.Task, a.Arguments, entry)
+	if err != nil {
+		log.Printf("Error queuing task %s: %v", id, err)
+	}
+
+	return accepted
+}
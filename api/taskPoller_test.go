@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/util"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPollTasks(t *testing.T) {
+	pid, tid := bson.NewObjectId(), bson.NewObjectId()
+
+	var mu sync.Mutex
+	polls, claims := 0, 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/agent/tasks":
+			polls++
+			if r.URL.Query().Get("agent") != "agent-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			// The task is assigned again on the second poll, as when the
+			// answer to a claim is lost.
+			var tasks []AssignedTask
+			if polls <= 2 {
+				tasks = append(tasks, AssignedTask{PipelineId: pid, Task: types.Task{Id: tid, Type: types.BuildTask}})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"code": 0, "payload": tasks})
+		case "/agent/tasks/claim":
+			claims++
+			w.Write([]byte(`{"code":0}`))
+		default:
+			w.Write([]byte(`{"code":0}`))
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	client := NewControlPlaneClient(srv.URL, "key", time.Second, 0)
+
+	queue, _, err := NewTaskQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := NewTaskHistory(filepath.Join(dir, "tasks"), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := NewOutbox(filepath.Join(dir, "outbox"), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor, err := util.NewRedactor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scheduler{
+		cfg:      SchedulerConfig{ApiBaseUrl: srv.URL, AgentId: "agent-1", TaskWorkers: 2, ApiTimeout: time.Second, PollInterval: 50 * time.Millisecond},
+		redactor: redactor,
+		queue:    queue,
+		history:  history,
+		api:      client,
+		outbox:   outbox,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.PollTasks(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := polls
+		mu.Unlock()
+
+		if n > 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d polls", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The task assigned again is claimed again but queued once.
+	if claims != 2 {
+		t.Fatalf("task claimed %d times, want twice", claims)
+	}
+	if queue.Len() != 1 {
+		t.Fatalf("got %d queued tasks, want 1", queue.Len())
+	}
+	if _, ok := queue.Get(queuedTaskId(pid, tid)); !ok {
+		t.Fatal("claimed task not queued")
+	}
+
+	// The polls answered at once without a new task wait PollInterval.
+	start, n := time.Now(), polls
+	mu.Unlock()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go s.PollTasks(ctx)
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	if elapsed := time.Since(start); polls-n > int(elapsed/s.cfg.PollInterval)+2 {
+		t.Fatalf("%d polls in %s, want at most one per %s", polls-n, elapsed, s.cfg.PollInterval)
+	}
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/util"
+)
+
+// Tasks interrupted this many times by an agent crash are given up on instead
+// of being run again.
+const maxTaskAttempts = 3
+
+// QueuedTask is a webhook task accepted by the agent, persisted until it has
+// run.
+type QueuedTask struct {
+	Id         string         `json:"id"`
+	PipelineId types.ObjectId `json:"pipelineId"`
+	TaskId     types.ObjectId `json:"taskId"`
+	Type       string         `json:"type"`
+	Timeout    int64          `json:"timeout"`
+	Config     interface{}    `json:"config"`
+	Arguments  []string       `json:"arguments,omitempty"`
+	EnqueuedAt time.Time      `json:"enqueuedAt"`
+	StartedAt  time.Time      `json:"startedAt,omitempty"`
+	Attempts   int            `json:"attempts"`
+
+	// Audit is the entry recorded once the task has run, with the caller
+	// captured when the task was accepted.
+	Audit AuditEntry `json:"audit"`
+
+	cancel context.CancelCauseFunc
+}
+
+func queuedTaskId(pipelineId, taskId types.ObjectId) string {
+	return pipelineId.Hex() + "_" + taskId.Hex()
+}
+
+// TaskQueue is a FIFO of tasks backed by one JSON file per task, so that the
+// tasks accepted but not finished before a crash or restart are run again.
+type TaskQueue struct {
+	dir string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*QueuedTask
+	running map[string]*QueuedTask
+	closed  bool
+}
+
+// NewTaskQueue loads the tasks left in dir. Tasks that were running are queued
+// again, unless they already ran maxTaskAttempts times; those are returned
+// separately and removed.
+func NewTaskQueue(dir string) (*TaskQueue, []*QueuedTask, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	q := &TaskQueue{dir: dir, running: map[string]*QueuedTask{}}
+	q.cond = sync.NewCond(&q.mu)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var abandoned []*QueuedTask
+	for _, f := range files {
+		bs, err := os.ReadFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var t QueuedTask
+		if err := json.Unmarshal(bs, &t); err != nil {
+			log.Printf("Skipping corrupt queued task %s: %v", f, err)
+			continue
+		}
+
+		if t.Attempts >= maxTaskAttempts {
+			abandoned = append(abandoned, &t)
+			os.Remove(f)
+			continue
+		}
+
+		if !t.StartedAt.IsZero() {
+			log.Printf("Task %s was interrupted after %d attempt(s), queuing it again", t.Id, t.Attempts)
+		}
+
+		q.pending = append(q.pending, &t)
+	}
+
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].EnqueuedAt.Before(q.pending[j].EnqueuedAt) })
+
+	return q, abandoned, nil
+}
+
+func (q *TaskQueue) path(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *TaskQueue) save(t *QueuedTask) error {
+	bs, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(q.path(t.Id), bs, 0600)
+}
+
+// Push persists t and queues it. The task is only accepted once it is on disk.
+func (q *TaskQueue) Push(t *QueuedTask) error {
+	if strings.ContainsAny(t.Id, `/\`) || t.Id == "" {
+		return fmt.Errorf("invalid task id %q", t.Id)
+	}
+
+	if t.EnqueuedAt.IsZero() {
+		t.EnqueuedAt = time.Now().UTC()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return fmt.Errorf("task queue is closed")
+	}
+
+	if err := q.save(t); err != nil {
+		return err
+	}
+
+	q.pending = append(q.pending, t)
+	q.cond.Broadcast()
+
+	return nil
+}
+
+// Pop waits for the oldest task accepted by accept and marks it as running
+// until Done is called. accept is called with the queue locked and may
+// reserve resources for the task it accepts; a nil accept takes any task. The
+// task is cancelled with cancel. Pop returns false once the queue is closed.
+func (q *TaskQueue) Pop(accept func(*QueuedTask) bool, cancel context.CancelCauseFunc) (*QueuedTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := -1
+	for !q.closed {
+		if i = q.next(accept); i >= 0 {
+			break
+		}
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return nil, false
+	}
+
+	t := q.pending[i]
+	q.pending = append(q.pending[:i], q.pending[i+1:]...)
+	q.running[t.Id] = t
+	t.cancel = cancel
+
+	t.StartedAt = time.Now().UTC()
+	t.Attempts++
+	if err := q.save(t); err != nil {
+		log.Printf("Error persisting task %s: %v", t.Id, err)
+	}
+
+	return t, true
+}
+
+func (q *TaskQueue) next(accept func(*QueuedTask) bool) int {
+	for i, t := range q.pending {
+		if accept == nil || accept(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Wake makes the waiting workers look at the queued tasks again, after the
+// resources a task was waiting for have been released.
+func (q *TaskQueue) Wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cond.Broadcast()
+}
+
+// Done removes a task that has run or was cancelled.
+func (q *TaskQueue) Done(t *QueuedTask) error {
+	q.mu.Lock()
+	delete(q.running, t.Id)
+	q.mu.Unlock()
+
+	err := os.Remove(q.path(t.Id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Get returns the task id, queued or running.
+func (q *TaskQueue) Get(id string) (*QueuedTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if t, ok := q.running[id]; ok {
+		return t, true
+	}
+
+	for _, t := range q.pending {
+		if t.Id == id {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// Cancel takes the task id out of the queue, or cancels its context with
+// cause when it is running. started reports which one happened.
+func (q *TaskQueue) Cancel(id string, cause error) (t *QueuedTask, started bool, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if t, ok := q.running[id]; ok {
+		if t.cancel != nil {
+			t.cancel(cause)
+		}
+		return t, true, true
+	}
+
+	for i, t := range q.pending {
+		if t.Id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return t, false, true
+		}
+	}
+	return nil, false, false
+}
+
+// CancelRunning cancels the context of every running task with cause and
+// returns how many were cancelled.
+func (q *TaskQueue) CancelRunning(cause error) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, t := range q.running {
+		if t.cancel != nil {
+			t.cancel(cause)
+		}
+	}
+	return len(q.running)
+}
+
+// Tasks returns the running tasks and then the queued ones, oldest first.
+func (q *TaskQueue) Tasks() []TaskInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	res := make([]TaskInfo, 0, len(q.running)+len(q.pending))
+	for _, t := range q.running {
+		res = append(res, newTaskInfo(t, TaskStateRunning))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].EnqueuedAt.Before(res[j].EnqueuedAt) })
+
+	for _, t := range q.pending {
+		res = append(res, newTaskInfo(t, TaskStateQueued))
+	}
+	return res
+}
+
+// Len returns the number of tasks waiting to run.
+func (q *TaskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending)
+}
+
+// Close wakes up the waiting workers. Tasks still queued stay on disk and are
+// loaded again on the next start.
+func (q *TaskQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTaskQueueRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	q, _, err := NewTaskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := bson.NewObjectId()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		task := &QueuedTask{Id: queuedTaskId(pid, bson.NewObjectId()), PipelineId: pid, Type: "Build", Config: map[string]interface{}{"imageName": "app"}}
+		if err := q.Push(task); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, task.Id)
+	}
+
+	first, ok := q.Pop(nil, nil)
+	if !ok || first.Id != ids[0] {
+		t.Fatalf("got %v, want the first pushed task", first)
+	}
+	if err := q.Done(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second task is running when the agent stops.
+	if second, _ := q.Pop(nil, nil); second.Id != ids[1] {
+		t.Fatalf("got %s, want %s", second.Id, ids[1])
+	}
+	q.Close()
+
+	q, abandoned, err := NewTaskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(abandoned) != 0 || q.Len() != 2 {
+		t.Fatalf("got %d queued and %d abandoned tasks, want 2 and 0", q.Len(), len(abandoned))
+	}
+
+	second, _ := q.Pop(nil, nil)
+	if second.Id != ids[1] || second.Attempts != 2 {
+		t.Fatalf("got %s after %d attempts, want %s to be run again", second.Id, second.Attempts, ids[1])
+	}
+	if cfg, _ := second.Config.(map[string]interface{}); cfg["imageName"] != "app" {
+		t.Fatalf("config not persisted: %v", second.Config)
+	}
+
+	third, _ := q.Pop(nil, nil)
+	if third.Id != ids[2] {
+		t.Fatalf("got %s, want %s", third.Id, ids[2])
+	}
+	q.Close()
+
+	// A task that keeps crashing the agent is eventually given up on.
+	given := 0
+	for i := 0; i < maxTaskAttempts; i++ {
+		q, abandoned, err = NewTaskQueue(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		given += len(abandoned)
+		for q.Len() > 0 {
+			q.Pop(nil, nil)
+		}
+		q.Close()
+	}
+	if given != 2 {
+		t.Fatalf("got %d abandoned tasks, want 2", given)
+	}
+}
+
+func TestTaskQueueCancel(t *testing.T) {
+	q, _, err := NewTaskQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := bson.NewObjectId()
+	running := &QueuedTask{Id: queuedTaskId(pid, bson.NewObjectId()), Type: "Deploy"}
+	queued := &QueuedTask{Id: queuedTaskId(pid, bson.NewObjectId()), Type: "Deploy"}
+	q.Push(running)
+	q.Push(queued)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	q.Pop(nil, cancel)
+
+	if tasks := q.Tasks(); len(tasks) != 2 || tasks[0].State != TaskStateRunning || tasks[1].State != TaskStateQueued {
+		t.Fatalf("got %+v, want one running and one queued task", tasks)
+	}
+
+	if _, started, ok := q.Cancel(queued.Id, nil); !ok || started || q.Len() != 0 {
+		t.Fatal("want the queued task removed")
+	}
+
+	if _, started, ok := q.Cancel(running.Id, errors.New("cancelled by alice")); !ok || !started {
+		t.Fatal("want the running task cancelled")
+	}
+	if context.Cause(ctx).Error() != "cancelled by alice" {
+		t.Fatalf("got cause %v", context.Cause(ctx))
+	}
+
+	q.Done(running)
+	if _, _, ok := q.Cancel(running.Id, nil); ok {
+		t.Fatal("want finished tasks not found")
+	}
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TaskCancelled is reported to the control plane for cancelled tasks.
+const TaskCancelled = "Cancelled"
+
+const (
+	TaskStateQueued    = "queued"
+	TaskStateRunning   = "running"
+	TaskStateCancelled = "cancelled"
+)
+
+var ErrTaskNotFound = errors.New("task not found")
+
+type TaskInfo struct {
+	Id         string         `json:"id"`
+	PipelineId types.ObjectId `json:"pipelineId"`
+	TaskId     types.ObjectId `json:"taskId"`
+	Type       string         `json:"type"`
+	Target     string         `json:"target,omitempty"`
+	Service    string         `json:"service,omitempty"`
+	State      string         `json:"state"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	EnqueuedAt time.Time      `json:"enqueuedAt"`
+	StartedAt  time.Time      `json:"startedAt,omitempty"`
+	FinishedAt time.Time      `json:"finishedAt,omitempty"`
+	Attempts   int            `json:"attempts"`
+}
+
+func newTaskInfo(t *QueuedTask, state string) TaskInfo {
+	return TaskInfo{
+		Id:         t.Id,
+		PipelineId: t.PipelineId,
+		TaskId:     t.TaskId,
+		Type:       t.Type,
+		Target:     taskTarget(t.Config),
+		Service:    taskService(t),
+		State:      state,
+		Status:     types.TaskInProgress,
+		EnqueuedAt: t.EnqueuedAt,
+		StartedAt:  t.StartedAt,
+		Attempts:   t.Attempts,
+	}
+}
+
+// CancelTask removes a queued task or cancels the context of a running one,
+// which aborts its clone, build, push or pull. Either way the task reports
+// TaskCancelled once.
+func (s *Scheduler) CancelTask(id, by string) (*QueuedTask, error) {
+	t, started, ok := s.queue.Cancel(id, errors.New("cancelled by "+by))
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	if !started {
+		s.finishTask(t, time.Now(), TaskCancelled, errors.New("cancelled by "+by+" before it started"))
+	}
+
+	return t, nil
+}
+
+// taskStatus returns the terminal status of a task that ran under ctx and
+// returned err.
+func taskStatus(ctx context.Context, err error) string {
+	if err == nil {
+		return types.TaskDone
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return types.TaskTimedOut
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return TaskCancelled
+	}
+
+	return types.TaskFailed
+}
+
+// findTask returns the state of a queued or running task, or of a task
+// finished within the history retention period.
+func (s *Scheduler) findTask(id string) (TaskInfo, bool) {
+	for _, t := range s.queue.Tasks() {
+		if t.Id == id {
+			return t, true
+		}
+	}
+
+	return s.history.Get(id)
+}
+
+// GetTasks lists the running and queued tasks, then the finished ones still
+// in the history, most recent first.
+func (s *Scheduler) GetTasks() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p := PrincipalFrom(ctx)
+
+		tasks := s.queue.Tasks()
+		finished := s.history.Finished()
+		for i := len(finished) - 1; i >= 0; i-- {
+			tasks = append(tasks, finished[i])
+		}
+
+		res := []TaskInfo{}
+		for _, t := range tasks {
+			if p == nil || t.Service == "" || p.CanAccessService(t.Service) {
+				res = append(res, t)
+			}
+		}
+
+		ctx.JSON(http.StatusOK, model.ApiResponse{Payload: res})
+	}
+}
+
+func (s *Scheduler) GetTask() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		t, ok := s.findTask(ctx.Param("id"))
+		if !ok {
+			ctx.JSON(http.StatusNotFound, model.ApiResponse{Msg: ErrTaskNotFound.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		if t.Service != "" && !authorizeService(ctx, t.Service) {
+			return
+		}
+
+		ctx.JSON(http.StatusOK, model.ApiResponse{Payload: t})
+	}
+}
+
+func (s *Scheduler) DeleteTask() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		s.cancelTask(ctx, ctx.Param("id"))
+	}
+}
+
+// CancelTaskWebhookHandler cancels the task identified by the pipeline and
+// task ids of a webhook payload.
+func (s *Scheduler) CancelTaskWebhookHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		body, err := io.ReadAll(ctx.Request.Body)
+
+		if err != nil {
+			ctx.JSON(bodyErrorStatus(err), types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		var sw types.StreamWebhook
+		err = json.Unmarshal(body, &sw)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		s.cancelTask(ctx, queuedTaskId(sw.Payload.PipelineId, sw.Payload.TaskId))
+	}
+}
+
+func (s *Scheduler) cancelTask(ctx *gin.Context, id string) {
+	t, ok := s.queue.Get(id)
+	if !ok {
+		ctx.JSON(http.StatusNotFound, model.ApiResponse{Msg: ErrTaskNotFound.Error(), Code: types.CodeClientError})
+		return
+	}
+
+	if !authorizeTask(ctx, t.Type, t.Config) {
+		return
+	}
+
+	by := "anonymous"
+	if p := PrincipalFrom(ctx); p != nil {
+		by = p.Subject
+	}
+
+	t, err := s.CancelTask(id, by)
+
+	if errors.Is(err, ErrTaskNotFound) {
+		ctx.JSON(http.StatusNotFound, model.ApiResponse{Msg: err.Error(), Code: types.CodeClientError})
+		return
+	}
+
+	info := newTaskInfo(t, TaskStateCancelled)
+	info.Status = TaskCancelled
+	ctx.JSON(http.StatusOK, model.ApiResponse{Payload: info})
+}
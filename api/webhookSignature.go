@@ -0,0 +1,116 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	types "deploybot-service-agent/deploybot-types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HeaderWebhookTimestamp = "X-Deploybot-Timestamp"
+	HeaderWebhookNonce     = "X-Deploybot-Nonce"
+	HeaderWebhookSignature = "X-Deploybot-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	ErrMissingSignature = errors.New("missing webhook signature")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleTimestamp   = errors.New("webhook timestamp outside the allowed window")
+	ErrReplayedNonce    = errors.New("webhook nonce already used")
+)
+
+// WebhookVerifier authenticates webhook bodies signed by the control plane.
+// The signature is the hex HMAC-SHA256 of "<timestamp>.<nonce>.<body>" keyed
+// with the shared secret. Nonces are remembered for twice the allowed clock
+// skew, which covers every timestamp that would still be accepted.
+type WebhookVerifier struct {
+	secret  []byte
+	maxSkew time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewWebhookVerifier(secret string, maxSkew time.Duration) *WebhookVerifier {
+	return &WebhookVerifier{secret: []byte(secret), maxSkew: maxSkew, nonces: map[string]time.Time{}}
+}
+
+// SignWebhook returns the signature header value for body.
+func SignWebhook(secret string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "." + nonce + "."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Middleware verifies the request signature and restores the body for the
+// next handler.
+func (v *WebhookVerifier) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.AbortWithStatusJSON(bodyErrorStatus(err), types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		err = v.verify(ctx.Request.Header, body, time.Now())
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, types.WebhookResponse{Msg: err.Error(), Code: types.CodeClientError})
+			return
+		}
+
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		ctx.Next()
+	}
+}
+
+func (v *WebhookVerifier) verify(h http.Header, body []byte, now time.Time) error {
+	ts, nonce, sig := h.Get(HeaderWebhookTimestamp), h.Get(HeaderWebhookNonce), h.Get(HeaderWebhookSignature)
+	if ts == "" || nonce == "" || sig == "" {
+		return ErrMissingSignature
+	}
+
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	if !strings.HasPrefix(sig, signaturePrefix) || !hmac.Equal([]byte(sig), []byte(SignWebhook(string(v.secret), timestamp, nonce, body))) {
+		return ErrInvalidSignature
+	}
+
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > v.maxSkew || skew < -v.maxSkew {
+		return ErrStaleTimestamp
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for n, seen := range v.nonces {
+		if now.Sub(seen) > 2*v.maxSkew {
+			delete(v.nonces, n)
+		}
+	}
+
+	if _, ok := v.nonces[nonce]; ok {
+		return ErrReplayedNonce
+	}
+	v.nonces[nonce] = now
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedHeader(secret string, ts time.Time, nonce string, body []byte) http.Header {
+	h := http.Header{}
+	h.Set(HeaderWebhookTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	h.Set(HeaderWebhookNonce, nonce)
+	h.Set(HeaderWebhookSignature, SignWebhook(secret, ts.Unix(), nonce, body))
+	return h
+}
+
+func TestWebhookVerifier(t *testing.T) {
+	v := NewWebhookVerifier("secret", 5*time.Minute)
+	now := time.Now()
+	body := []byte(`{"payload":{}}`)
+
+	if err := v.verify(signedHeader("secret", now, "n1", body), body, now); err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		h    http.Header
+		body []byte
+		want error
+	}{
+		{"unsigned", http.Header{}, body, ErrMissingSignature},
+		{"wrong secret", signedHeader("other", now, "n2", body), body, ErrInvalidSignature},
+		{"tampered body", signedHeader("secret", now, "n3", body), []byte(`{}`), ErrInvalidSignature},
+		{"stale", signedHeader("secret", now.Add(-10*time.Minute), "n4", body), body, ErrStaleTimestamp},
+		{"replayed", signedHeader("secret", now, "n1", body), body, ErrReplayedNonce},
+	}
+
+	for _, c := range cases {
+		if err := v.verify(c.h, c.body, now); err != c.want {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"sync"
+
+	types "deploybot-service-agent/deploybot-types"
+	"deploybot-service-agent/model"
+)
+
+// taskSlots limits how many tasks of each type run at once and serializes
+// everything acting on the same service, so that two deploys of a service
+// never interleave their stop/remove/create steps.
+type taskSlots struct {
+	limits map[string]int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	running  map[string]int
+	services map[string]bool
+}
+
+// newTaskSlots returns slots allowing limits[type] concurrent tasks of each
+// type. Types without a positive limit are not limited.
+func newTaskSlots(limits map[string]int) *taskSlots {
+	p := &taskSlots{limits: limits, running: map[string]int{}, services: map[string]bool{}}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// tryAcquire takes a slot for a task of type typ acting on service, unless
+// the type is at its limit or the service is busy. An empty service is never
+// busy.
+func (p *taskSlots) tryAcquire(typ, service string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l := p.limits[typ]; l > 0 && p.running[typ] >= l {
+		return false
+	}
+
+	if service != "" && p.services[service] {
+		return false
+	}
+
+	p.running[typ]++
+	if service != "" {
+		p.services[service] = true
+	}
+
+	return true
+}
+
+func (p *taskSlots) release(typ, service string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running[typ]--
+	if service != "" {
+		delete(p.services, service)
+	}
+	p.cond.Broadcast()
+}
+
+// lockService waits until no task or request acts on service and claims it.
+func (p *taskSlots) lockService(service string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.services[service] {
+		p.cond.Wait()
+	}
+	p.services[service] = true
+}
+
+func (p *taskSlots) unlockService(service string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.services, service)
+	p.cond.Broadcast()
+}
+
+// taskService returns the service a queued task deploys, or "" for tasks that
+// do not act on a service.
+func taskService(t *QueuedTask) string {
+	if t.Type != types.DeployTask {
+		return ""
+	}
+
+	var c model.DeployConfig
+	decodeConfig(t.Config, &c)
+	return c.ServiceName
+}
+
+// lockService serializes API requests acting on a service with the deploy
+// tasks of the same service.
+func (s *Scheduler) lockService(name string) func() {
+	s.slots.lockService(name)
+
+	return func() {
+		s.slots.unlockService(name)
+		s.queue.Wake()
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTaskSlots(t *testing.T) {
+	p := newTaskSlots(map[string]int{"Build": 1, "Deploy": 2})
+
+	if !p.tryAcquire("Build", "") || p.tryAcquire("Build", "") {
+		t.Fatal("want a single build slot")
+	}
+
+	if !p.tryAcquire("Deploy", "web") || p.tryAcquire("Deploy", "web") {
+		t.Fatal("want deploys of the same service serialized")
+	}
+	if !p.tryAcquire("Deploy", "db") || p.tryAcquire("Deploy", "cache") {
+		t.Fatal("want two deploy slots")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		p.lockService("web")
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lockService returned while a deploy of the service is running")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.release("Deploy", "web")
+	<-locked
+
+	if p.tryAcquire("Deploy", "web") {
+		t.Fatal("want the deploy to wait for the API request")
+	}
+	p.unlockService("web")
+
+	if !p.tryAcquire("Deploy", "web") {
+		t.Fatal("want the deploy to run once the service is unlocked")
+	}
+}
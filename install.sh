@@ -54,6 +54,9 @@ BOT_AGENT_DIR="$USER_HOME/.bot_agent"
 mkdir -p "$BOT_AGENT_DIR"
 chmod 755 "$BOT_AGENT_DIR"
 
+# Random key used to authenticate inbound API requests
+GENERATED_KEY=$(head -c 32 /dev/urandom | od -An -tx1 | tr -d ' \n')
+
 # Create or update environment configuration
 if [ ! -f "$ENV_FILE" ]; then
   # Create new environment file
@@ -68,6 +71,7 @@ DH_USERNAME=your_dockerhub_username
 DH_PASSWORD=your_dockerhub_password
 REPO_USERNAME=your_repo_username
 REPO_PASSWORD=your_repo_password
+AUTH_API_KEY=$GENERATED_KEY
 EOF
   chmod 600 "$ENV_FILE"
   echo "Created environment file at $ENV_FILE"
@@ -90,6 +94,7 @@ else
     ["DH_PASSWORD"]="your_dockerhub_password"
     ["REPO_USERNAME"]="your_repo_username"
     ["REPO_PASSWORD"]="your_repo_password"
+    ["AUTH_API_KEY"]="$GENERATED_KEY"
   )
   
   # Copy existing file to temp
@@ -314,6 +319,10 @@ Type=simple
 ExecStart=$PROGRAM_PATH start
 Restart=on-failure
 RestartSec=30s
+# On stop the agent drains its tasks for up to SHUTDOWN_TIMEOUT (60s), then
+# waits up to API_TIMEOUT (10s) each to flush task statuses, go offline and
+# close connections. Keep this above their sum.
+TimeoutStopSec=150s
 User=$INSTALLER_USER
 Group=docker
 EnvironmentFile=$ENV_FILE
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
 
 	"deploybot-service-agent/api"
+	"deploybot-service-agent/util"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -15,16 +27,76 @@ import (
 var Version string // This will be set during build using -ldflags
 
 type Config struct {
-	ServicePort  string `envconfig:"SERVICE_PORT"`
-	ServiceCrt   string `envconfig:"SERVICE_CRT"`
-	ServiceKey   string `envconfig:"SERVICE_KEY"`
+	ServicePort       string `envconfig:"SERVICE_PORT"`
+	ServiceCrt        string `envconfig:"SERVICE_CRT"`
+	ServiceKey        string `envconfig:"SERVICE_KEY"`
+	ServiceClientCa   string `envconfig:"SERVICE_CLIENT_CA"`
+	ServiceClientAuth string `envconfig:"SERVICE_CLIENT_AUTH" default:"require"`
+
+	ServiceTlsAuto  bool     `envconfig:"SERVICE_TLS_AUTO"`
+	ServiceTlsHosts []string `envconfig:"SERVICE_TLS_HOSTS"`
+
+	CertReloadInterval time.Duration `envconfig:"CERT_RELOAD_INTERVAL" default:"1m"`
+
 	ApiBaseUrl   string `envconfig:"API_BASE_URL"`
-	ApiKey       string `envconfig:"API_KEY"`
+	ApiKey       string `envconfig:"API_KEY" secret:"true"`
 	DockerHost   string `envconfig:"DOCKER_HOST"`
 	DhUsername   string `envconfig:"DH_USERNAME"`
-	DhPassword   string `envconfig:"DH_PASSWORD"`
+	DhPassword   string `envconfig:"DH_PASSWORD" secret:"true"`
 	RepoUsername string `envconfig:"REPO_USERNAME"`
-	RepoPassword string `envconfig:"REPO_PASSWORD"`
+	RepoPassword string `envconfig:"REPO_PASSWORD" secret:"true"`
+	DataDir      string `envconfig:"DATA_DIR"`
+	SecretsKey   string `envconfig:"SECRETS_KEY" secret:"true"`
+
+	HostPathAllowlist []string `envconfig:"HOST_PATH_ALLOWLIST"`
+
+	AuthDisabled          bool   `envconfig:"AUTH_DISABLED"`
+	AuthApiKey            string `envconfig:"AUTH_API_KEY" secret:"true"`
+	AuthTokenSecret       string `envconfig:"AUTH_TOKEN_SECRET" secret:"true"`
+	AuthTokensFile        string `envconfig:"AUTH_TOKENS_FILE"`
+	AuthExemptHealthCheck bool   `envconfig:"AUTH_EXEMPT_HEALTH_CHECK" default:"true"`
+
+	WebhookSecret  string        `envconfig:"WEBHOOK_SECRET" secret:"true"`
+	WebhookMaxSkew time.Duration `envconfig:"WEBHOOK_MAX_SKEW" default:"5m"`
+
+	AuditMaxSizeMb int `envconfig:"AUDIT_MAX_SIZE_MB" default:"10"`
+	AuditMaxFiles  int `envconfig:"AUDIT_MAX_FILES" default:"5"`
+
+	RedactKeyPatterns []string `envconfig:"REDACT_KEY_PATTERNS"`
+
+	RateLimitDefault    string `envconfig:"RATE_LIMIT_DEFAULT" default:"10:20"`
+	RateLimitHeavy      string `envconfig:"RATE_LIMIT_HEAVY" default:"0.1:3"`
+	RateLimitAuthFail   string `envconfig:"RATE_LIMIT_AUTH_FAILURES" default:"0.1:10"`
+	MaxRequestBodyBytes int64  `envconfig:"MAX_REQUEST_BODY_BYTES" default:"1048576"`
+
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES"`
+
+	TaskWorkers       int `envconfig:"TASK_WORKERS" default:"3"`
+	BuildConcurrency  int `envconfig:"BUILD_CONCURRENCY" default:"1"`
+	DeployConcurrency int `envconfig:"DEPLOY_CONCURRENCY" default:"2"`
+
+	TaskLogUpload        bool          `envconfig:"TASK_LOG_UPLOAD" default:"true"`
+	TaskHistoryRetention time.Duration `envconfig:"TASK_HISTORY_RETENTION" default:"168h"`
+	TaskDedupWindow      time.Duration `envconfig:"TASK_DEDUP_WINDOW" default:"5m"`
+
+	ApiTimeout    time.Duration `envconfig:"API_TIMEOUT" default:"10s"`
+	ApiMaxRetries int           `envconfig:"API_MAX_RETRIES" default:"3"`
+
+	AgentMode    string        `envconfig:"AGENT_MODE" default:"webhook"`
+	AgentId      string        `envconfig:"AGENT_ID"`
+	PollWait     time.Duration `envconfig:"POLL_WAIT" default:"30s"`
+	PollInterval time.Duration `envconfig:"POLL_INTERVAL" default:"5s"`
+
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"60s"`
+
+	HeartbeatInterval  time.Duration `envconfig:"HEARTBEAT_INTERVAL" default:"30s"`
+	HeartbeatDiskPaths []string      `envconfig:"HEARTBEAT_DISK_PATHS" default:"/"`
+
+	CorsEnabled          bool     `envconfig:"CORS_ENABLED" default:"true"`
+	CorsAllowOrigins     []string `envconfig:"CORS_ALLOW_ORIGINS" default:"*"`
+	CorsAllowMethods     []string `envconfig:"CORS_ALLOW_METHODS" default:"GET,POST,PUT,DELETE"`
+	CorsAllowHeaders     []string `envconfig:"CORS_ALLOW_HEADERS" default:"Origin,Content-Type,Authorization,X-Api-Key"`
+	CorsAllowCredentials bool     `envconfig:"CORS_ALLOW_CREDENTIALS"`
 }
 
 func main() {
@@ -34,6 +106,23 @@ func main() {
 		panic(err)
 	}
 
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.DataDir == "" {
+		cfg.DataDir = filepath.Join(home, ".bot_agent")
+	}
+
+	if len(cfg.HostPathAllowlist) == 0 {
+		cfg.HostPathAllowlist = []string{home}
+	}
+
+	if len(cfg.RedactKeyPatterns) == 0 {
+		cfg.RedactKeyPatterns = util.DefaultRedactPatterns
+	}
+
 	if len(os.Args) > 1 {
 		arg1 := os.Args[1]
 
@@ -43,7 +132,11 @@ func main() {
 		case "version":
 			fmt.Println(Version)
 		case "env":
-			fmt.Printf("%+v\n", cfg)
+			printConfig(os.Stdout, cfg, len(os.Args) > 2 && os.Args[2] == "--reveal")
+		case "token":
+			issueToken(cfg, os.Args[2:])
+		case "certs":
+			manageCerts(cfg, os.Args[2:])
 		default:
 			fmt.Println("Unknown command line arguments", os.Args)
 		}
@@ -53,19 +146,150 @@ func main() {
 
 }
 
+// printConfig prints cfg to w with the fields tagged secret masked, unless
+// reveal is set.
+func printConfig(w io.Writer, cfg Config, reveal bool) {
+	if !reveal {
+		v := reflect.ValueOf(&cfg).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if v.Type().Field(i).Tag.Get("secret") == "true" && f.String() != "" {
+				f.SetString(util.RedactedValue)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%+v\n", cfg)
+}
+
+func issueToken(cfg Config, args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	role := fs.String("role", string(api.RoleRead), "role granted by the token: read, operator or admin")
+	services := fs.String("services", "", "comma-separated service name globs the token is restricted to")
+	ttl := fs.Duration("ttl", 24*time.Hour, "token lifetime")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: token [-role read|operator|admin] [-services glob,...] [-ttl 24h] <subject>")
+		return
+	}
+
+	var globs []string
+	if *services != "" {
+		globs = strings.Split(*services, ",")
+	}
+
+	token, err := api.IssueToken(cfg.AuthTokenSecret, fs.Arg(0), api.Role(*role), globs, *ttl)
+	if err != nil {
+		fmt.Println("Error issuing token:", err)
+		return
+	}
+
+	fmt.Println(token)
+}
+
+// manageCerts (re)issues the server certificate of the internal CA, or a client
+// certificate with "certs client <name>".
+func manageCerts(cfg Config, args []string) {
+	ca := util.InternalCA{Dir: filepath.Join(cfg.DataDir, "certs")}
+
+	if len(args) > 0 && args[0] == "client" {
+		fs := flag.NewFlagSet("certs client", flag.ExitOnError)
+		out := fs.String("out", ".", "directory the certificate and key are written to")
+		fs.Parse(args[1:])
+
+		if fs.NArg() != 1 {
+			fmt.Println("Usage: certs client [-out dir] <name>")
+			return
+		}
+
+		name := fs.Arg(0)
+		certFile, keyFile := filepath.Join(*out, name+".crt"), filepath.Join(*out, name+".key")
+		if err := ca.IssueClientCert(name, certFile, keyFile); err != nil {
+			fmt.Println("Error issuing client certificate:", err)
+			return
+		}
+
+		fmt.Println("Client certificate:", certFile)
+		fmt.Println("Client key:", keyFile)
+		fmt.Println("Set SERVICE_CLIENT_CA to", ca.CertFile(), "to accept it")
+		return
+	}
+
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	hosts := fs.String("hosts", strings.Join(certHosts(cfg), ","), "comma-separated host names and IP addresses of the server certificate")
+	force := fs.Bool("force", false, "reissue the server certificate even if it is still valid")
+	fs.Parse(args)
+
+	if _, err := ca.EnsureServerCert(strings.Split(*hosts, ","), *force); err != nil {
+		fmt.Println("Error issuing server certificate:", err)
+		return
+	}
+
+	printCertInfo(ca)
+}
+
+// useInternalCert points SERVICE_CRT and SERVICE_KEY at the server certificate
+// of the internal CA, issuing it first when needed.
+func useInternalCert(cfg *Config) error {
+	ca := util.InternalCA{Dir: filepath.Join(cfg.DataDir, "certs")}
+
+	if _, err := ca.EnsureServerCert(certHosts(*cfg), false); err != nil {
+		return err
+	}
+
+	cfg.ServiceCrt, cfg.ServiceKey = ca.ServerCertFile(), ca.ServerKeyFile()
+	printCertInfo(ca)
+
+	return nil
+}
+
+func certHosts(cfg Config) []string {
+	if len(cfg.ServiceTlsHosts) > 0 {
+		return cfg.ServiceTlsHosts
+	}
+	return util.DefaultCertHosts()
+}
+
+func printCertInfo(ca util.InternalCA) {
+	fingerprint, err := ca.Fingerprint()
+	if err != nil {
+		fmt.Println("Error reading CA certificate:", err)
+		return
+	}
+
+	fmt.Println("CA certificate:", ca.CertFile())
+	fmt.Println("CA SHA-256 fingerprint:", fingerprint)
+	fmt.Println("Server certificate:", ca.ServerCertFile())
+}
+
 func initService(cfg Config) {
+	if cfg.AgentMode != api.AgentModeWebhook && cfg.AgentMode != api.AgentModePull {
+		fmt.Printf("Error starting service: AGENT_MODE must be %s or %s, got %q\n", api.AgentModeWebhook, api.AgentModePull, cfg.AgentMode)
+		return
+	}
+
 	g := gin.Default()
 
-	g.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * 60 * 60, // Maximum cache age (12 hours)
-	}))
+	// The client IP used for rate limits and the audit log is only taken from
+	// X-Forwarded-For when the request comes from one of TRUSTED_PROXIES.
+	if err := g.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fmt.Println("Error configuring TRUSTED_PROXIES:", err)
+		return
+	}
+
+	// Preflight requests match no route and are answered by the CORS
+	// middleware from the 404 handler chain, so every route is covered.
+	if cfg.CorsEnabled {
+		corsCfg, err := newCorsConfig(cfg)
+		if err != nil {
+			fmt.Println("Error configuring CORS:", err)
+			return
+		}
+		g.Use(cors.New(corsCfg))
+	}
 
-	a := api.NewScheduler(api.SchedulerConfig{
+	a, err := api.NewScheduler(api.SchedulerConfig{
 		ApiBaseUrl:   cfg.ApiBaseUrl,
 		ApiKey:       cfg.ApiKey,
 		DockerHost:   cfg.DockerHost,
@@ -73,53 +297,289 @@ func initService(cfg Config) {
 		DhPassword:   cfg.DhPassword,
 		RepoUsername: cfg.RepoUsername,
 		RepoPassword: cfg.RepoPassword,
+
+		HostPathAllowlist: cfg.HostPathAllowlist,
+
+		DataDir:       cfg.DataDir,
+		AuditMaxSize:  int64(cfg.AuditMaxSizeMb) << 20,
+		AuditMaxFiles: cfg.AuditMaxFiles,
+		SecretsKey:    cfg.SecretsKey,
+
+		RedactPatterns: cfg.RedactKeyPatterns,
+
+		TaskWorkers:       cfg.TaskWorkers,
+		BuildConcurrency:  cfg.BuildConcurrency,
+		DeployConcurrency: cfg.DeployConcurrency,
+		TaskLogUpload:     cfg.TaskLogUpload,
+
+		TaskHistoryRetention: cfg.TaskHistoryRetention,
+		TaskDedupWindow:      cfg.TaskDedupWindow,
+
+		ApiTimeout:    cfg.ApiTimeout,
+		ApiMaxRetries: cfg.ApiMaxRetries,
+
+		AgentMode:    cfg.AgentMode,
+		AgentId:      cfg.AgentId,
+		PollWait:     cfg.PollWait,
+		PollInterval: cfg.PollInterval,
+
+		Version:            Version,
+		HeartbeatInterval:  cfg.HeartbeatInterval,
+		HeartbeatDiskPaths: cfg.HeartbeatDiskPaths,
 	})
+	if err != nil {
+		fmt.Println("Error starting service:", err)
+		return
+	}
+
+	defaultLimit, err := api.ParseRateLimit(cfg.RateLimitDefault)
+	if err != nil {
+		fmt.Println("Error configuring RATE_LIMIT_DEFAULT:", err)
+		return
+	}
+
+	heavyLimit, err := api.ParseRateLimit(cfg.RateLimitHeavy)
+	if err != nil {
+		fmt.Println("Error configuring RATE_LIMIT_HEAVY:", err)
+		return
+	}
+
+	authFailLimit, err := api.ParseRateLimit(cfg.RateLimitAuthFail)
+	if err != nil {
+		fmt.Println("Error configuring RATE_LIMIT_AUTH_FAILURES:", err)
+		return
+	}
+
+	limiter, heavy := api.NewRateLimiter(defaultLimit), api.NewRateLimiter(heavyLimit)
+	followLogs := heavy.MiddlewareWhen(func(ctx *gin.Context) bool { return ctx.Query("follow") == "true" })
+
+	g.Use(api.BodyLimit(cfg.MaxRequestBodyBytes))
+
+	audit := a.AuditMiddleware()
+	read, operator, admin := g.Group("/", audit), g.Group("/", audit), g.Group("/", audit)
+	if cfg.AuthDisabled {
+		fmt.Println("WARNING: authentication is disabled, every route is publicly accessible")
+	} else {
+		auth, err := api.NewAuthenticator(api.AuthConfig{
+			ApiKey:      cfg.AuthApiKey,
+			TokenSecret: cfg.AuthTokenSecret,
+			TokensFile:  cfg.AuthTokensFile,
+		})
+		if err != nil {
+			fmt.Println("Error configuring authentication:", err, "(set AUTH_API_KEY, AUTH_TOKEN_SECRET or AUTH_TOKENS_FILE, or AUTH_DISABLED=true)")
+			return
+		}
+		// Failed authentications are limited per IP before authenticating,
+		// so that credentials cannot be guessed at the default rate.
+		authFailures := api.NewRateLimiter(authFailLimit).FailureMiddleware(http.StatusUnauthorized)
+		read.Use(authFailures, auth.Middleware(), auth.Require(api.RoleRead))
+		operator.Use(authFailures, auth.Middleware(), auth.Require(api.RoleOperator))
+		admin.Use(authFailures, auth.Middleware(), auth.Require(api.RoleAdmin))
+	}
+	read.Use(limiter.Middleware())
+	operator.Use(limiter.Middleware())
+	admin.Use(limiter.Middleware())
 
 	// Define API routes
-	g.POST("/streamWebhook", a.StreamWebhookHandler())
-	g.GET("/healthCheck", a.HealthCheckHandler())
-	g.GET("/serviceLogs", a.GetServiceLog())
-	g.GET("/serviceLogs/:name", a.GetServiceLog())
-	g.GET("/diskInfo/:path", a.GetDiskInfo())
-	g.DELETE("/images", a.DeleteImages())
-	g.DELETE("/builderCache", a.DeleteBuilderCache())
-	g.GET("/network/:name", a.GetNetwork())
-	g.GET("/networks", a.GetNetworks())
-	g.DELETE("/network/:name", a.DeleteNetwork())
-	g.POST("/network", a.CreateNetwork())
-	g.GET("/service/:name", a.GetService())
-	g.GET("/services", a.GetServices())
-	g.DELETE("/service/:name", a.DeleteService())
-	g.PUT("/service/:name", a.UpdateService())
-	g.POST("/service", a.CreateService())
-
-	// OPTIONS routes for CORS preflight requests
-	g.OPTIONS("/streamWebhook", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/healthCheck", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/serviceLogs", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/diskInfo", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/images", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/builderCache", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/networks", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/network", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/network/:name", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/service/:name", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/services", func(c *gin.Context) { c.Status(http.StatusOK) })
-	g.OPTIONS("/service", func(c *gin.Context) { c.Status(http.StatusOK) })
-
-	tlsConfig := &http.Server{
+	if cfg.AuthExemptHealthCheck {
+		g.GET("/healthCheck", a.HealthCheckHandler())
+	} else {
+		read.GET("/healthCheck", a.HealthCheckHandler())
+	}
+	read.GET("/serviceLogs", followLogs, a.GetServiceLog())
+	read.GET("/serviceLogs/:name", followLogs, a.GetServiceLog())
+	read.GET("/diskInfo/:path", a.GetDiskInfo())
+	read.GET("/network/:name", a.GetNetwork())
+	read.GET("/networks", a.GetNetworks())
+	read.GET("/service/:name", a.GetService())
+	read.GET("/services", a.GetServices())
+	read.GET("/tasks", a.GetTasks())
+	read.GET("/tasks/:id", a.GetTask())
+	read.GET("/tasks/:id/logs", followLogs, a.GetTaskLog())
+
+	webhook := operator.Group("/")
+	if cfg.WebhookSecret != "" {
+		verifier := api.NewWebhookVerifier(cfg.WebhookSecret, cfg.WebhookMaxSkew)
+		webhook.Use(verifier.Middleware())
+	} else {
+		fmt.Println("WARNING: WEBHOOK_SECRET is not set, webhook bodies are not verified")
+	}
+	webhook.POST("/streamWebhook", a.StreamWebhookHandler())
+	webhook.POST("/cancelWebhook", a.CancelTaskWebhookHandler())
+	operator.POST("/network", a.CreateNetwork())
+	operator.DELETE("/service/:name", a.DeleteService())
+	operator.PUT("/service/:name", a.UpdateService())
+	operator.POST("/service", heavy.Middleware(), a.CreateService())
+	operator.DELETE("/tasks/:id", a.DeleteTask())
+
+	admin.DELETE("/images", heavy.Middleware(), a.DeleteImages())
+	admin.DELETE("/builderCache", heavy.Middleware(), a.DeleteBuilderCache())
+	admin.DELETE("/network/:name", a.DeleteNetwork())
+	admin.GET("/audit", a.GetAuditLog())
+	admin.GET("/secrets", a.GetSecrets())
+	admin.PUT("/secret/:name", a.SetSecret())
+	admin.DELETE("/secret/:name", a.DeleteSecret())
+
+	a.StartWorkers()
+
+	background, stopBackground := context.WithCancel(context.Background())
+
+	if cfg.AgentMode == api.AgentModePull {
+		go a.PollTasks(background)
+	}
+
+	if cfg.HeartbeatInterval > 0 {
+		go a.RunHeartbeat(background)
+	}
+
+	server := &http.Server{
 		Addr:    cfg.ServicePort,
 		Handler: g,
 	}
 
-	var err error
+	stopped := make(chan struct{})
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		fmt.Printf("Received %s, shutting down (send it again to exit now)\n", sig)
+		go func() {
+			<-stop
+			os.Exit(1)
+		}()
+
+		stopBackground()
+		shutdown(cfg, a, server)
+		close(stopped)
+	}()
+
+	if cfg.ServiceTlsAuto && cfg.ServiceCrt == "" && cfg.ServiceKey == "" {
+		if err := useInternalCert(&cfg); err != nil {
+			fmt.Println("Error issuing internal certificate:", err)
+			return
+		}
+	}
+
 	if cfg.ServiceCrt == "" || cfg.ServiceKey == "" {
-		err = tlsConfig.ListenAndServe()
+		if cfg.ServiceClientCa != "" {
+			fmt.Println("Error starting service: SERVICE_CLIENT_CA requires SERVICE_CRT and SERVICE_KEY")
+			return
+		}
+		err = server.ListenAndServe()
 	} else {
-		err = tlsConfig.ListenAndServeTLS(cfg.ServiceCrt, cfg.ServiceKey)
+		server.TLSConfig, err = newTLSConfig(cfg)
+		if err == nil {
+			// The certificate comes from TLSConfig.GetCertificate
+			err = server.ListenAndServeTLS("", "")
+		}
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+		return
 	}
 
 	if err != nil {
 		fmt.Println("Error starting service:", err)
 	}
 }
+
+// shutdown waits for the running tasks, up to SHUTDOWN_TIMEOUT, and delivers
+// their status before marking the agent offline and stopping the server.
+// Webhooks are refused from the start with 503.
+func shutdown(cfg Config, a *api.Scheduler, server *http.Server) {
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	a.Drain(drainCtx)
+	cancel()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.ApiTimeout)
+	if err := a.Flush(flushCtx); err != nil {
+		fmt.Println("Error delivering task statuses:", err)
+	}
+	cancel()
+
+	if cfg.HeartbeatInterval > 0 {
+		offlineCtx, cancel := context.WithTimeout(context.Background(), cfg.ApiTimeout)
+		if err := a.GoOffline(offlineCtx); err != nil {
+			fmt.Println("Error marking the agent offline:", err)
+		}
+		cancel()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ApiTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Error stopping the server:", err)
+	}
+}
+
+func newCorsConfig(cfg Config) (cors.Config, error) {
+	corsCfg := cors.Config{
+		AllowOrigins:     cfg.CorsAllowOrigins,
+		AllowMethods:     cfg.CorsAllowMethods,
+		AllowHeaders:     cfg.CorsAllowHeaders,
+		ExposeHeaders:    []string{"Content-Length"},
+		AllowCredentials: cfg.CorsAllowCredentials,
+		MaxAge:           12 * time.Hour, // Maximum cache age
+	}
+
+	for _, o := range cfg.CorsAllowOrigins {
+		if o == "*" {
+			if cfg.CorsAllowCredentials {
+				return corsCfg, fmt.Errorf("CORS_ALLOW_CREDENTIALS cannot be combined with the * origin")
+			}
+			corsCfg.AllowAllOrigins, corsCfg.AllowOrigins = true, nil
+		}
+	}
+
+	return corsCfg, corsCfg.Validate()
+}
+
+// newTLSConfig serves SERVICE_CRT/SERVICE_KEY and reloads them when the files
+// change or on SIGHUP.
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	reloader, err := util.NewCertReloader(cfg.ServiceCrt, cfg.ServiceKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CertReloadInterval > 0 {
+		go reloader.Watch(cfg.CertReloadInterval, nil)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloader.Reload(); err != nil {
+				fmt.Println("Error reloading certificate:", err)
+			} else {
+				fmt.Println("Reloaded certificate", cfg.ServiceCrt)
+			}
+		}
+	}()
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+
+	if cfg.ServiceClientCa == "" {
+		return tlsCfg, nil
+	}
+
+	pool, err := util.LoadCertPool(cfg.ServiceClientCa)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.ClientCAs = pool
+
+	switch cfg.ServiceClientAuth {
+	case "require":
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid SERVICE_CLIENT_AUTH %q, expected require or optional", cfg.ServiceClientAuth)
+	}
+
+	return tlsCfg, nil
+}
@@ -1,9 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"deploybot-service-agent/util"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
 )
 
 func TestServiceLogHandler(t *testing.T) {
@@ -21,3 +34,152 @@ func TestServiceLogHandler(t *testing.T) {
 
 	t.Log(out)
 }
+
+func TestPrintConfig(t *testing.T) {
+	cfg := Config{ApiKey: "api-key", DhPassword: "dh-password", AuthTokenSecret: "token-secret", DhUsername: "deployer"}
+
+	var out bytes.Buffer
+	printConfig(&out, cfg, false)
+
+	for _, secret := range []string{"api-key", "dh-password", "token-secret"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("secret %q printed: %s", secret, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "ApiKey:"+util.RedactedValue) || !strings.Contains(out.String(), "DhUsername:deployer") {
+		t.Errorf("got %s, want masked secrets and plain values", out.String())
+	}
+
+	// Empty secrets are left empty, so that unset values stay visible.
+	if strings.Contains(out.String(), "RepoPassword:"+util.RedactedValue) {
+		t.Errorf("empty secret masked: %s", out.String())
+	}
+
+	out.Reset()
+	printConfig(&out, cfg, true)
+
+	if !strings.Contains(out.String(), "ApiKey:api-key") {
+		t.Errorf("got %s, want the revealed secrets", out.String())
+	}
+}
+
+func TestCorsConfig(t *testing.T) {
+	cfg := Config{
+		CorsAllowOrigins: []string{"https://ui.example.com"},
+		CorsAllowMethods: []string{"GET", "DELETE"},
+		CorsAllowHeaders: []string{"Authorization"},
+	}
+
+	corsCfg, err := newCorsConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := gin.New()
+	g.Use(cors.New(corsCfg))
+
+	// The routes require authentication, which a preflight never carries.
+	unauthorized := func(ctx *gin.Context) { ctx.AbortWithStatus(http.StatusUnauthorized) }
+	g.GET("/services", unauthorized)
+	g.DELETE("/service/:name", unauthorized)
+
+	do := func(method, path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	// Preflights are answered for every route, without authentication.
+	for _, path := range []string{"/services", "/service/web"} {
+		w := do(http.MethodOptions, path, "https://ui.example.com")
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://ui.example.com" {
+			t.Errorf("preflight %s: got %d, allowed origin %q", path, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), http.MethodDelete) {
+			t.Errorf("preflight %s: allowed methods %q", path, w.Header().Get("Access-Control-Allow-Methods"))
+		}
+	}
+
+	// Other origins are refused.
+	if w := do(http.MethodOptions, "/service/web", "https://evil.example.com"); w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight from another origin: got %d, allowed origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if w := do(http.MethodGet, "/services", "https://evil.example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("request from another origin: got %d", w.Code)
+	}
+
+	// Requests from the allowed origin reach the route.
+	if w := do(http.MethodGet, "/services", "https://ui.example.com"); w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") != "https://ui.example.com" {
+		t.Errorf("request from the allowed origin: got %d, allowed origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// The * origin allows every origin, but not with credentials.
+	cfg.CorsAllowOrigins = []string{"*"}
+	if corsCfg, err := newCorsConfig(cfg); err != nil || !corsCfg.AllowAllOrigins {
+		t.Errorf("* origin: AllowAllOrigins %v, err %v", corsCfg.AllowAllOrigins, err)
+	}
+
+	cfg.CorsAllowCredentials = true
+	if _, err := newCorsConfig(cfg); err == nil {
+		t.Error("* origin with credentials accepted")
+	}
+}
+
+func TestTLSConfigReloadOnSIGHUP(t *testing.T) {
+	ca := util.InternalCA{Dir: t.TempDir()}
+	if _, err := ca.EnsureServerCert([]string{"one.example.com"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsCfg, err := newTLSConfig(Config{ServiceCrt: ca.ServerCertFile(), ServiceKey: ca.ServerKeyFile()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := func() string {
+		cert, err := tlsCfg.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	if _, err := ca.EnsureServerCert([]string{"two.example.com"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without CERT_RELOAD_INTERVAL, the renewal is only picked up on SIGHUP.
+	if name := served(); name != "one.example.com" {
+		t.Fatalf("serving %s before SIGHUP", name)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); served() != "two.example.com"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded on SIGHUP")
+		}
+	}
+
+	// A pair that does not match is refused and the current one kept.
+	if err := os.Rename(filepath.Join(ca.Dir, "ca.key"), ca.ServerKeyFile()); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	time.Sleep(100 * time.Millisecond)
+
+	if name := served(); name != "two.example.com" {
+		t.Fatalf("serving %s after an invalid renewal", name)
+	}
+}
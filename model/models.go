@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type BuildConfig struct {
 	ImageName  string             `json:"imageName"`
 	ImageTag   string             `json:"imageTag" bson:",omitempty"`
@@ -35,6 +37,12 @@ type DeployConfig struct {
 	Links         []string          `json:"links" bson:",omitempty"`
 	LogConfig     *LogConfig        `json:"logConfig" bson:",omitempty"`
 	ShmSize       int64             `json:"shmSize" bson:",omitempty"`
+
+	// WaitHealthy makes the deploy wait for the Docker healthcheck of the
+	// image to report healthy, and MinUptime for the container to then stay
+	// up for that many seconds, before the deploy succeeds.
+	WaitHealthy bool `json:"waitHealthy" bson:",omitempty"`
+	MinUptime   int  `json:"minUptime" bson:",omitempty"`
 }
 
 type Network struct {
@@ -96,3 +104,48 @@ type UpdateServiceInput struct {
 	Running    bool   `json:"running"`
 	Restarting bool   `json:"restarting"`
 }
+
+type SecretInfo struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type SetSecretInput struct {
+	Value string `json:"value"`
+}
+
+// TaskLogChunk is a part of a task log uploaded to the API, starting at byte
+// Offset of the log.
+type TaskLogChunk struct {
+	PipelineId string `json:"pipelineId"`
+	TaskId     string `json:"taskId"`
+	Offset     int64  `json:"offset"`
+	Content    string `json:"content"`
+}
+
+type ContainerInfo struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	State  string `json:"state"`
+	Status string `json:"status"`
+}
+
+// AgentInfo is what the agent reports about itself and its host when it
+// registers and in every heartbeat.
+type AgentInfo struct {
+	AgentId       string          `json:"agentId"`
+	Mode          string          `json:"mode"`
+	Version       string          `json:"version"`
+	DockerVersion string          `json:"dockerVersion,omitempty"`
+	StartedAt     time.Time       `json:"startedAt"`
+	QueuedTasks   int             `json:"queuedTasks"`
+	RunningTasks  int             `json:"runningTasks"`
+	Disks         []DiskInfo      `json:"disks"`
+	Containers    []ContainerInfo `json:"containers"`
+	Networks      []Network       `json:"networks"`
+}
+
+type AgentOfflineInput struct {
+	AgentId string `json:"agentId"`
+}
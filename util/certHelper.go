@@ -0,0 +1,386 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", file)
+	}
+
+	return pool, nil
+}
+
+// CertReloader serves a certificate key pair from disk through
+// tls.Config.GetCertificate and swaps in a new pair when the files change, so
+// renewals apply to new connections without restarting the server.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the key pair again. The current certificate is kept when the
+// files cannot be loaded, e.g. while they are being replaced.
+func (r *CertReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Watch reloads the key pair whenever the modification time of either file
+// changes, checking every interval until stop is closed.
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		modTime, err := r.latestModTime()
+		if err != nil {
+			log.Println("Error checking certificate files:", err)
+			continue
+		}
+
+		r.mu.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			log.Println("Error reloading certificate:", err)
+		} else {
+			log.Println("Reloaded certificate", r.certFile)
+		}
+	}
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+const (
+	caValidity     = 10 * 365 * 24 * time.Hour
+	leafValidity   = 365 * 24 * time.Hour
+	leafRenewAhead = 30 * 24 * time.Hour
+)
+
+// InternalCA locates the files of the agent's self-managed certificate
+// authority and the server certificate it issues.
+type InternalCA struct {
+	Dir string
+}
+
+func (ca InternalCA) CertFile() string       { return filepath.Join(ca.Dir, "ca.crt") }
+func (ca InternalCA) KeyFile() string        { return filepath.Join(ca.Dir, "ca.key") }
+func (ca InternalCA) ServerCertFile() string { return filepath.Join(ca.Dir, "server.crt") }
+func (ca InternalCA) ServerKeyFile() string  { return filepath.Join(ca.Dir, "server.key") }
+
+// EnsureServerCert creates the CA when it does not exist and (re)issues the
+// server certificate when it is missing, expires within 30 days, does not
+// cover hosts or force is set. It reports whether a new certificate was
+// issued. Hosts must not be empty or blank.
+func (ca InternalCA) EnsureServerCert(hosts []string, force bool) (bool, error) {
+	if len(hosts) == 0 {
+		return false, errors.New("no host names for the server certificate")
+	}
+
+	names := make([]string, len(hosts))
+	for i, h := range hosts {
+		if names[i] = strings.TrimSpace(h); names[i] == "" {
+			return false, fmt.Errorf("empty host name in %q", strings.Join(hosts, ","))
+		}
+	}
+	hosts = names
+
+	caCert, caKey, err := ca.loadOrCreate()
+	if err != nil {
+		return false, err
+	}
+
+	if !force {
+		if cert, err := readCertFile(ca.ServerCertFile()); err == nil && time.Until(cert.NotAfter) > leafRenewAhead && certCovers(cert, hosts) && cert.CheckSignatureFrom(caCert) == nil {
+			return false, nil
+		}
+	}
+
+	tmpl, err := leafTemplate(hosts[0], x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return false, err
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	return true, issueCert(tmpl, caCert, caKey, ca.ServerCertFile(), ca.ServerKeyFile())
+}
+
+// IssueClientCert issues a client certificate with common name name, for use
+// with mutual TLS when SERVICE_CLIENT_CA points at the internal CA.
+func (ca InternalCA) IssueClientCert(name, certFile, keyFile string) error {
+	caCert, caKey, err := ca.loadOrCreate()
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := leafTemplate(name, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return err
+	}
+
+	return issueCert(tmpl, caCert, caKey, certFile, keyFile)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the CA certificate in the
+// colon-separated hex form printed by openssl.
+func (ca InternalCA) Fingerprint() (string, error) {
+	cert, err := readCertFile(ca.CertFile())
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":"), nil
+}
+
+func (ca InternalCA) loadOrCreate() (*x509.Certificate, crypto.Signer, error) {
+	cert, err := readCertFile(ca.CertFile())
+	if err == nil {
+		key, err := readKeyFile(ca.KeyFile())
+		return cert, key, err
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "bot_agent internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	if err := issueCertWithKey(tmpl, tmpl, key, key, ca.CertFile(), ca.KeyFile()); err != nil {
+		return nil, nil, err
+	}
+
+	cert, err = readCertFile(ca.CertFile())
+	return cert, key, err
+}
+
+func leafTemplate(commonName string, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}, nil
+}
+
+func issueCert(tmpl, caCert *x509.Certificate, caKey crypto.Signer, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	return issueCertWithKey(tmpl, caCert, key, caKey, certFile, keyFile)
+}
+
+func issueCertWithKey(tmpl, parent *x509.Certificate, key *ecdsa.PrivateKey, signer crypto.Signer, certFile, keyFile string) error {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// The key is written first so that a certificate reloader never pairs the
+	// new certificate with the old key.
+	if err := WriteFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func readCertFile(file string) (*x509.Certificate, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bs)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate found", file)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKeyFile(file string) (crypto.Signer, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key found", file)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type", file)
+	}
+
+	return signer, nil
+}
+
+func certCovers(cert *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// DefaultCertHosts returns the hostname, the loopback names and the addresses
+// of the up network interfaces of this machine.
+func DefaultCertHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+	if name, err := os.Hostname(); err == nil && name != "localhost" {
+		hosts = append([]string{name}, hosts...)
+	}
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+
+	return hosts
+}
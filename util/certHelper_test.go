@@ -0,0 +1,137 @@
+package util
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func servedName(t *testing.T, r *CertReloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := InternalCA{Dir: t.TempDir()}
+	if _, err := ca.EnsureServerCert([]string{"one.example.com"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewCertReloader(ca.ServerCertFile(), ca.ServerKeyFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, r); name != "one.example.com" {
+		t.Fatalf("serving %s", name)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(10*time.Millisecond, stop)
+
+	// A renewed pair is picked up once the files change.
+	if _, err := ca.EnsureServerCert([]string{"two.example.com"}, true); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(ca.ServerCertFile(), later, later)
+
+	for deadline := time.Now().Add(5 * time.Second); servedName(t, r) != "two.example.com"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate not loaded")
+		}
+	}
+
+	// An invalid pair is refused and the current certificate kept.
+	if err := os.WriteFile(ca.ServerCertFile(), []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("invalid certificate loaded")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if name := servedName(t, r); name != "two.example.com" {
+		t.Fatalf("serving %s after an invalid renewal", name)
+	}
+}
+
+func TestInternalCA(t *testing.T) {
+	ca := InternalCA{Dir: t.TempDir()}
+
+	// Blank host names are refused before anything is created.
+	for _, hosts := range [][]string{nil, {""}, {"agent.internal", " "}} {
+		if _, err := ca.EnsureServerCert(hosts, false); err == nil {
+			t.Errorf("hosts %q accepted", hosts)
+		}
+	}
+	if _, err := os.Stat(ca.CertFile()); !os.IsNotExist(err) {
+		t.Fatalf("CA created for invalid hosts: %v", err)
+	}
+
+	issued, err := ca.EnsureServerCert([]string{"agent.internal", " 10.0.0.5"}, false)
+	if err != nil || !issued {
+		t.Fatalf("issued %v, err %v", issued, err)
+	}
+
+	caCert, err := readCertFile(ca.CertFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caCert.IsCA {
+		t.Fatal("CA certificate is not a CA")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	// The server certificate is signed by the CA and covers exactly the hosts.
+	server, err := readCertFile(ca.ServerCertFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.DNSNames) != 1 || server.DNSNames[0] != "agent.internal" || len(server.IPAddresses) != 1 || server.IPAddresses[0].String() != "10.0.0.5" {
+		t.Errorf("SANs: DNS %v, IP %v", server.DNSNames, server.IPAddresses)
+	}
+	for _, host := range []string{"agent.internal", "10.0.0.5"} {
+		if _, err := server.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("verify %s: %v", host, err)
+		}
+	}
+
+	// A valid certificate is kept; a new host or -force reissues it.
+	if issued, err := ca.EnsureServerCert([]string{"agent.internal"}, false); err != nil || issued {
+		t.Errorf("covered hosts: issued %v, err %v", issued, err)
+	}
+	if issued, err := ca.EnsureServerCert([]string{"agent.example.com"}, false); err != nil || !issued {
+		t.Errorf("new host: issued %v, err %v", issued, err)
+	}
+	if issued, err := ca.EnsureServerCert([]string{"agent.example.com"}, true); err != nil || !issued {
+		t.Errorf("forced: issued %v, err %v", issued, err)
+	}
+
+	// The CA is kept and signs client certificates too.
+	if err := ca.IssueClientCert("ci-runner", filepath.Join(ca.Dir, "ci.crt"), filepath.Join(ca.Dir, "ci.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := readCertFile(filepath.Join(ca.Dir, "ci.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Subject.CommonName != "ci-runner" {
+		t.Errorf("client common name %q", client.Subject.CommonName)
+	}
+	if _, err := client.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("verify client certificate: %v", err)
+	}
+}
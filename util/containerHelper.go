@@ -1,13 +1,16 @@
 package util
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"os"
 	"strings"
+	"time"
 
 	"deploybot-service-agent/model"
 
@@ -18,6 +21,7 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 )
 
@@ -27,8 +31,10 @@ type DhCredentials struct {
 }
 
 type ContainerHelper struct {
-	cli  *client.Client
-	cred DhCredentials
+	cli     *client.Client
+	cred    DhCredentials
+	guard   *PathGuard
+	secrets *SecretStore
 }
 
 type ChLogsOptions struct {
@@ -42,30 +48,100 @@ type ChLogsOptions struct {
 	Since      string
 }
 
-func NewContainerHelper(dockerHost string, cred DhCredentials) *ContainerHelper {
+func NewContainerHelper(dockerHost string, cred DhCredentials, guard *PathGuard, secrets *SecretStore) *ContainerHelper {
 	cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
 	if err != nil {
 		panic(err)
 	}
-	return &ContainerHelper{cli, cred}
+	return &ContainerHelper{cli, cred, guard, secrets}
 }
 
-func (h *ContainerHelper) StartContainer(cfg *model.DeployConfig) error {
-	ctx := context.Background()
+// ValidateHostPaths checks every file and volume mount source of cfg against
+// the allowed host paths and rewrites them to their canonical form.
+func (h *ContainerHelper) ValidateHostPaths(cfg *model.DeployConfig) error {
+	if cfg.Files != nil {
+		files := make(map[string]string, len(cfg.Files))
+		for name, content := range cfg.Files {
+			p, err := h.guard.Resolve(name)
+			if err != nil {
+				return err
+			}
+			files[p] = content
+		}
+		cfg.Files = files
+	}
 
-	h.cli.ContainerStop(ctx, cfg.ServiceName, container.StopOptions{})
-	h.cli.ContainerRemove(ctx, cfg.ServiceName, container.RemoveOptions{})
+	if cfg.VolumeMounts != nil {
+		mounts := make(map[string]string, len(cfg.VolumeMounts))
+		for src, target := range cfg.VolumeMounts {
+			p, err := h.guard.Resolve(src)
+			if err != nil {
+				return err
+			}
+			mounts[p] = target
+		}
+		cfg.VolumeMounts = mounts
+	}
+
+	return nil
+}
+
+// StartContainer replaces the container of cfg.ServiceName, writing the pull
+// progress to out. The image is pulled before the running container is
+// stopped, so that a failed or cancelled pull leaves it running.
+func (h *ContainerHelper) StartContainer(ctx context.Context, cfg *model.DeployConfig, out io.Writer) error {
+	if err := h.ValidateHostPaths(cfg); err != nil {
+		return err
+	}
 
 	imageNameTag := cfg.ImageName + ":" + cfg.ImageTag
 	reader, err := h.cli.ImagePull(ctx, imageNameTag, image.PullOptions{})
 	if err != nil {
 		return err
 	}
-	io.Copy(os.Stdout, reader)
+	defer reader.Close()
+
+	if err := readDockerStream(reader, out, nil); err != nil {
+		return err
+	}
+
+	// Secret references are resolved into copies so that cfg never holds the
+	// plaintext values. They are resolved, and the files written, before the
+	// running container is stopped, so that a missing secret leaves it running.
+	env := make([]string, len(cfg.Env))
+	for i, e := range cfg.Env {
+		env[i], err = h.secrets.Expand(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	files := make(map[string]string, len(cfg.Files))
+	for name, content := range cfg.Files {
+		files[name], err = h.secrets.Expand(content)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, content := range files {
+		if err := WriteToFile(name, content); err != nil {
+			return err
+		}
+	}
+
+	for srcDir := range cfg.VolumeMounts {
+		if err := CreateDirsIfNotExist(srcDir); err != nil {
+			return err
+		}
+	}
+
+	h.cli.ContainerStop(ctx, cfg.ServiceName, container.StopOptions{})
+	h.cli.ContainerRemove(ctx, cfg.ServiceName, container.RemoveOptions{})
 
 	cConfig := &container.Config{
 		Image: imageNameTag,
-		Env:   cfg.Env,
+		Env:   env,
 	}
 
 	if cfg.Command != "" {
@@ -96,24 +172,6 @@ func (h *ContainerHelper) StartContainer(cfg *model.DeployConfig) error {
 		}
 	}
 
-	if cfg.Files != nil {
-		for name, content := range cfg.Files {
-			err = WriteToFile(name, content)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	if cfg.VolumeMounts != nil {
-		for srcDir := range cfg.VolumeMounts {
-			err = CreateDirsIfNotExist(srcDir)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
 	if cfg.VolumeMounts != nil {
 		for s, t := range cfg.VolumeMounts {
 			hConfig.Mounts = append(hConfig.Mounts, mount.Mount{Type: mount.TypeBind, Source: s, Target: t})
@@ -178,22 +236,21 @@ func (h *ContainerHelper) StopContainer(ctx context.Context, containerName strin
 	return h.cli.ContainerStop(ctx, containerName, container.StopOptions{})
 }
 
-func (h *ContainerHelper) GetContainer(ctx context.Context, containerId string) (interface{}, error) {
+func (h *ContainerHelper) GetContainer(ctx context.Context, containerId string) (types.ContainerJSON, error) {
 	return h.cli.ContainerInspect(ctx, containerId)
 }
 
-func (h *ContainerHelper) GetContainers(ctx context.Context) ([]interface{}, error) {
-	containers, err := h.cli.ContainerList(ctx, container.ListOptions{})
-	if err != nil {
-		return nil, err
-	}
+func (h *ContainerHelper) GetContainers(ctx context.Context) ([]types.Container, error) {
+	return h.cli.ContainerList(ctx, container.ListOptions{})
+}
 
-	var res []interface{}
-	for _, c := range containers {
-		res = append(res, c)
+func (h *ContainerHelper) GetServerVersion(ctx context.Context) (string, error) {
+	v, err := h.cli.ServerVersion(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	return res, nil
+	return v.Version, nil
 }
 
 func (h *ContainerHelper) CreateNetwork(ctx context.Context, networkName string) (string, error) {
@@ -263,21 +320,40 @@ func (h *ContainerHelper) RemoveBuilderCache(ctx context.Context) error {
 	return nil
 }
 
-func (h *ContainerHelper) BuildImage(buildContext io.Reader, buidOptions *types.ImageBuildOptions) error {
-	buildResponse, err := h.cli.ImageBuild(context.Background(), buildContext, *buidOptions)
+// BuildImage builds an image, writing the build steps to out, and returns the
+// id of the image. A failing step fails the build with the error reported by
+// Docker.
+func (h *ContainerHelper) BuildImage(ctx context.Context, buildContext io.Reader, buidOptions *types.ImageBuildOptions, out io.Writer) (string, error) {
+	buildResponse, err := h.cli.ImageBuild(ctx, buildContext, *buidOptions)
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	defer buildResponse.Body.Close()
 
-	io.Copy(os.Stdout, buildResponse.Body)
+	var imageId string
+	err = readDockerStream(buildResponse.Body, out, func(id string, data json.RawMessage) {
+		var res types.BuildResult
+		if (id == "" || id == auxImageId) && json.Unmarshal(data, &res) == nil && res.ID != "" {
+			imageId = res.ID
+		}
+	})
 
-	return nil
+	if err != nil {
+		return "", err
+	}
+
+	if imageId == "" {
+		return "", errors.New("build finished without an image id")
+	}
+
+	return imageId, nil
 }
 
-func (h *ContainerHelper) PushImage(name string) error {
+// PushImage pushes an image, writing the progress to out, and returns the
+// digest of the pushed manifest.
+func (h *ContainerHelper) PushImage(ctx context.Context, name string, out io.Writer) (string, error) {
 	authConfig := registry.AuthConfig{
 		Username: h.cred.Username,
 		Password: h.cred.Password,
@@ -285,13 +361,104 @@ func (h *ContainerHelper) PushImage(name string) error {
 	encodedJSON, _ := json.Marshal(authConfig)
 	authStr := base64.URLEncoding.EncodeToString(encodedJSON)
 
-	res, err := h.cli.ImagePush(context.Background(), name, image.PushOptions{RegistryAuth: authStr})
+	res, err := h.cli.ImagePush(ctx, name, image.PushOptions{RegistryAuth: authStr})
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	defer res.Close()
-	io.Copy(os.Stdout, res)
-	return nil
+
+	var digest string
+	err = readDockerStream(res, out, func(id string, data json.RawMessage) {
+		var r struct{ Digest string }
+		if json.Unmarshal(data, &r) == nil && r.Digest != "" {
+			digest = r.Digest
+		}
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// readyPollInterval is how often WaitContainerReady inspects the container.
+var readyPollInterval = time.Second
+
+// WaitContainerReady waits until the container has passed its Docker
+// healthcheck, when healthy is set, and has then been running for uptime
+// without restarting. It fails with the container's exit status, health
+// check output or last log lines when it stops, restarts or turns unhealthy.
+func (h *ContainerHelper) WaitContainerReady(ctx context.Context, name string, healthy bool, uptime time.Duration) error {
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	var restarts int
+	var runningSince time.Time
+	first := true
+
+	for {
+		c, err := h.cli.ContainerInspect(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		if first {
+			restarts, first = c.RestartCount, false
+		}
+
+		switch {
+		case c.State.Status == "exited" || c.State.Status == "dead":
+			return h.containerError(ctx, name, fmt.Sprintf("container %s exited with code %d", name, c.State.ExitCode), c.State.Error)
+		case c.RestartCount != restarts || c.State.Restarting:
+			return h.containerError(ctx, name, fmt.Sprintf("container %s restarted (exit code %d)", name, c.State.ExitCode), c.State.Error)
+		case healthy && c.State.Health == nil:
+			return fmt.Errorf("container %s has no healthcheck", name)
+		case healthy && c.State.Health.Status == types.Unhealthy:
+			return fmt.Errorf("container %s is unhealthy: %s", name, lastHealthOutput(c.State.Health))
+		}
+
+		if c.State.Running && (!healthy || c.State.Health.Status == types.Healthy) {
+			if runningSince.IsZero() {
+				runningSince = time.Now()
+			}
+			if time.Since(runningSince) >= uptime {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for container %s: %w", name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *ContainerHelper) containerError(ctx context.Context, name, msg, stateErr string) error {
+	if stateErr != "" {
+		msg += ": " + stateErr
+	}
+
+	out, err := h.cli.ContainerLogs(ctx, name, container.LogsOptions{ShowStdout: true, ShowStderr: true, Tail: "20"})
+	if err == nil {
+		defer out.Close()
+
+		var buf bytes.Buffer
+		stdcopy.StdCopy(&buf, &buf, out)
+		if logs := strings.TrimSpace(buf.String()); logs != "" {
+			msg += "\n" + logs
+		}
+	}
+
+	return errors.New(msg)
+}
+
+func lastHealthOutput(health *types.Health) string {
+	if len(health.Log) == 0 {
+		return health.Status
+	}
+	return strings.TrimSpace(health.Log[len(health.Log)-1].Output)
 }
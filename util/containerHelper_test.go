@@ -0,0 +1,205 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"deploybot-service-agent/model"
+)
+
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// newTestContainerHelper returns a helper talking to a fake Docker daemon. Its
+// requests are passed to handle, as "METHOD /path" without the API version,
+// and answered with an empty success when handle returns false. The returned
+// function lists the requests received so far.
+func newTestContainerHelper(t *testing.T, dir string, handle func(req string, w http.ResponseWriter) bool) (*ContainerHelper, func() []string) {
+	var mu sync.Mutex
+	var requests []string
+
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" {
+			w.Header().Set("Api-Version", "1.45")
+			return
+		}
+
+		req := r.Method + " " + apiVersionPrefix.ReplaceAllString(r.URL.Path, "")
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		if handle == nil || !handle(req, w) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(docker.Close)
+
+	guard, err := NewPathGuard([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := LoadOrCreateSecretKey("", filepath.Join(dir, "secrets.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := NewSecretStore(filepath.Join(dir, "secrets.json"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.Set("db_password", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewContainerHelper("tcp://"+strings.TrimPrefix(docker.URL, "http://"), DhCredentials{}, guard, secrets)
+
+	return h, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func TestStartContainerSecrets(t *testing.T) {
+	dir := t.TempDir()
+	h, requests := newTestContainerHelper(t, dir, func(req string, w http.ResponseWriter) bool {
+		switch req {
+		case "POST /images/create":
+			w.Write([]byte(`{"status":"Pulled"}`))
+		case "POST /containers/create":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"new"}`))
+		default:
+			return false
+		}
+		return true
+	})
+
+	stopped := func() bool {
+		for _, r := range requests() {
+			if r == "POST /containers/web/stop" || r == "DELETE /containers/web" {
+				return true
+			}
+		}
+		return false
+	}
+
+	file := filepath.Join(dir, "app.conf")
+
+	// A missing secret fails the deploy and leaves the running container.
+	for _, cfg := range []model.DeployConfig{
+		{ServiceName: "web", ImageName: "app", ImageTag: "1", Env: []string{"DB_PASSWORD=${secret:missing}"}},
+		{ServiceName: "web", ImageName: "app", ImageTag: "1", Files: map[string]string{file: "password=${secret:missing}"}},
+	} {
+		if err := h.StartContainer(context.Background(), &cfg, io.Discard); err == nil || !strings.Contains(err.Error(), "missing") {
+			t.Fatalf("got %v, want the missing secret", err)
+		}
+	}
+
+	if stopped() {
+		t.Fatalf("running container stopped: %v", requests())
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("file written: %v", err)
+	}
+
+	// With the secrets at hand, the files are written and the container replaced.
+	cfg := model.DeployConfig{ServiceName: "web", ImageName: "app", ImageTag: "1", Env: []string{"DB_PASSWORD=${secret:db_password}"}, Files: map[string]string{file: "password=${secret:db_password}"}}
+	if err := h.StartContainer(context.Background(), &cfg, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if !stopped() {
+		t.Fatalf("running container not replaced: %v", requests())
+	}
+	if bs, _ := os.ReadFile(file); string(bs) != "password=hunter2" {
+		t.Fatalf("file content %q", bs)
+	}
+	if cfg.Env[0] != "DB_PASSWORD=${secret:db_password}" {
+		t.Fatalf("config holds the secret: %v", cfg.Env)
+	}
+}
+
+func TestWaitContainerReady(t *testing.T) {
+	defer func(d time.Duration) { readyPollInterval = d }(readyPollInterval)
+	readyPollInterval = 10 * time.Millisecond
+
+	const (
+		running   = `"Status": "running", "Running": true`
+		exited    = `"Status": "exited", "ExitCode": 3`
+		healthy   = `, "Health": {"Status": "healthy"}`
+		starting  = `, "Health": {"Status": "starting"}`
+		unhealthy = `, "Health": {"Status": "unhealthy", "Log": [{"Output": "curl: connection refused\n"}]}`
+	)
+
+	// wait inspects a container going through states, the last one repeated.
+	wait := func(ctx context.Context, waitHealthy bool, uptime time.Duration, states ...string) error {
+		var mu sync.Mutex
+		n := 0
+
+		h, _ := newTestContainerHelper(t, t.TempDir(), func(req string, w http.ResponseWriter) bool {
+			if req != "GET /containers/web/json" {
+				return false
+			}
+
+			mu.Lock()
+			state := states[min(n, len(states)-1)]
+			n++
+			mu.Unlock()
+
+			w.Write([]byte(`{"Id": "abc", "Name": "/web", ` + state + `}`))
+			return true
+		})
+
+		return h.WaitContainerReady(ctx, "web", waitHealthy, uptime)
+	}
+
+	state := func(restarts int, s string) string {
+		return fmt.Sprintf(`"RestartCount": %d, "State": {%s}`, restarts, s)
+	}
+
+	for _, c := range []struct {
+		name        string
+		waitHealthy bool
+		uptime      time.Duration
+		states      []string
+		want        string
+	}{
+		{"exits", false, time.Hour, []string{state(0, running), state(0, exited)}, "exited with code 3"},
+		{"restarts", false, time.Hour, []string{state(2, running), state(3, running)}, "restarted"},
+		{"no healthcheck", true, 0, []string{state(0, running)}, "has no healthcheck"},
+		{"unhealthy", true, 0, []string{state(0, running+starting), state(0, running+unhealthy)}, "unhealthy: curl: connection refused"},
+		{"healthy", true, 0, []string{state(0, running+starting), state(0, running+healthy)}, ""},
+		{"min uptime", false, 50 * time.Millisecond, []string{state(1, running)}, ""},
+	} {
+		err := wait(context.Background(), c.waitHealthy, c.uptime, c.states...)
+		if c.want == "" && err != nil || c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.want)
+		}
+	}
+
+	// The minimum uptime is counted from the first running inspection.
+	start := time.Now()
+	if err := wait(context.Background(), false, 100*time.Millisecond, state(0, running)); err != nil || time.Since(start) < 100*time.Millisecond {
+		t.Errorf("min uptime: got %v after %s", err, time.Since(start))
+	}
+
+	// The wait ends with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := wait(ctx, false, time.Hour, state(0, running)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled: got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Auxiliary message ids of BuildKit builds.
+const (
+	auxBuildkitTrace = "moby.buildkit.trace"
+	auxImageId       = "moby.image.id"
+)
+
+// dockerMessage is a line of the JSON message stream returned by the Docker
+// build, push and pull endpoints.
+type dockerMessage struct {
+	Stream      string          `json:"stream"`
+	Status      string          `json:"status"`
+	Id          string          `json:"id"`
+	Progress    string          `json:"progress"`
+	Error       string          `json:"error"`
+	ErrorDetail *dockerError    `json:"errorDetail"`
+	Aux         json.RawMessage `json:"aux"`
+}
+
+type dockerError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// readDockerStream writes the progress reported by a Docker message stream to
+// out and returns the error the stream ends with, if any. aux is called with
+// the auxiliary messages other than BuildKit traces, which are printed as
+// build steps.
+func readDockerStream(in io.Reader, out io.Writer, aux func(id string, data json.RawMessage)) error {
+	dec := json.NewDecoder(in)
+	trace := buildkitTrace{out: out, vertexes: map[string]int{}}
+
+	for {
+		var m dockerMessage
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case m.ErrorDetail != nil && m.ErrorDetail.Message != "":
+			return errors.New(m.ErrorDetail.Message)
+		case m.Error != "":
+			return errors.New(m.Error)
+		case m.Id == auxBuildkitTrace && m.Aux != nil:
+			var bs []byte
+			if json.Unmarshal(m.Aux, &bs) == nil {
+				trace.print(bs)
+			}
+		case m.Aux != nil:
+			if aux != nil {
+				aux(m.Id, m.Aux)
+			}
+		case m.Stream != "":
+			io.WriteString(out, m.Stream)
+		case m.Status != "" && m.Progress == "":
+			// Progress bars are skipped, only the layer status changes are kept.
+			if m.Id != "" {
+				fmt.Fprintf(out, "%s: %s\n", m.Id, m.Status)
+			} else {
+				fmt.Fprintln(out, m.Status)
+			}
+		}
+	}
+}
+
+// buildkitTrace prints the steps and logs of the BuildKit status updates sent
+// as protobuf encoded moby.buildkit.v1.StatusResponse messages.
+type buildkitTrace struct {
+	out      io.Writer
+	vertexes map[string]int
+}
+
+// Field numbers of moby.buildkit.v1.StatusResponse, Vertex and VertexLog.
+const (
+	statusVertexes = 1
+	statusLogs     = 3
+
+	vertexDigest    = 1
+	vertexName      = 3
+	vertexCached    = 4
+	vertexCompleted = 6
+	vertexError     = 7
+
+	logVertex = 1
+	logMsg    = 4
+)
+
+func (t *buildkitTrace) print(bs []byte) {
+	forEachField(bs, func(num protowire.Number, v []byte) {
+		switch num {
+		case statusVertexes:
+			t.printVertex(v)
+		case statusLogs:
+			var vertex, msg string
+			forEachField(v, func(num protowire.Number, v []byte) {
+				switch num {
+				case logVertex:
+					vertex = string(v)
+				case logMsg:
+					msg = string(v)
+				}
+			})
+			for _, l := range strings.SplitAfter(msg, "\n") {
+				if l != "" {
+					fmt.Fprintf(t.out, "#%d %s", t.step(vertex), l)
+				}
+			}
+			if !strings.HasSuffix(msg, "\n") && msg != "" {
+				io.WriteString(t.out, "\n")
+			}
+		}
+	})
+}
+
+func (t *buildkitTrace) printVertex(bs []byte) {
+	var digest, name, errMsg string
+	var cached, completed bool
+
+	forEachField(bs, func(num protowire.Number, v []byte) {
+		switch num {
+		case vertexDigest:
+			digest = string(v)
+		case vertexName:
+			name = string(v)
+		case vertexCached:
+			cached = true
+		case vertexCompleted:
+			completed = true
+		case vertexError:
+			errMsg = string(v)
+		}
+	})
+
+	_, seen := t.vertexes[digest]
+	n := t.step(digest)
+
+	switch {
+	case errMsg != "":
+		fmt.Fprintf(t.out, "#%d %s ERROR: %s\n", n, name, errMsg)
+	case cached:
+		if !seen {
+			fmt.Fprintf(t.out, "#%d %s CACHED\n", n, name)
+		}
+	case completed:
+		fmt.Fprintf(t.out, "#%d DONE\n", n)
+	case !seen:
+		fmt.Fprintf(t.out, "#%d %s\n", n, name)
+	}
+}
+
+// step numbers the vertexes in the order they are first reported.
+func (t *buildkitTrace) step(digest string) int {
+	n, ok := t.vertexes[digest]
+	if !ok {
+		n = len(t.vertexes) + 1
+		t.vertexes[digest] = n
+	}
+	return n
+}
+
+// forEachField calls fn with the number and value of every field of a
+// protobuf message. Varint fields are passed as their decimal representation
+// and fixed size fields are skipped; decoding stops at the first malformed
+// field.
+func forEachField(bs []byte, fn func(protowire.Number, []byte)) {
+	for len(bs) > 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return
+		}
+		bs = bs[n:]
+
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(bs)
+			v = b
+		case protowire.VarintType:
+			var x uint64
+			x, n = protowire.ConsumeVarint(bs)
+			v = []byte(fmt.Sprint(x))
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, bs)
+		}
+		if n < 0 {
+			return
+		}
+		bs = bs[n:]
+
+		if v != nil {
+			fn(num, v)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestReadDockerStreamError(t *testing.T) {
+	stream := `{"stream":"Step 1/2 : FROM alpine\n"}
+{"stream":"Step 2/2 : RUN false\n"}
+{"errorDetail":{"code":1,"message":"The command '/bin/sh -c false' returned a non-zero code: 1"},"error":"The command '/bin/sh -c false' returned a non-zero code: 1"}
+`
+	var out bytes.Buffer
+	err := readDockerStream(strings.NewReader(stream), &out, nil)
+
+	if err == nil || !strings.Contains(err.Error(), "non-zero code: 1") {
+		t.Fatalf("got %v, want the failing step error", err)
+	}
+	if !strings.Contains(out.String(), "Step 2/2 : RUN false") {
+		t.Fatalf("steps not written: %q", out.String())
+	}
+}
+
+func TestReadDockerStreamBuildkit(t *testing.T) {
+	var vertex []byte
+	vertex = protowire.AppendTag(vertex, vertexDigest, protowire.BytesType)
+	vertex = protowire.AppendString(vertex, "sha256:abc")
+	vertex = protowire.AppendTag(vertex, vertexName, protowire.BytesType)
+	vertex = protowire.AppendString(vertex, "[2/2] RUN make")
+
+	var vlog []byte
+	vlog = protowire.AppendTag(vlog, logVertex, protowire.BytesType)
+	vlog = protowire.AppendString(vlog, "sha256:abc")
+	vlog = protowire.AppendTag(vlog, logMsg, protowire.BytesType)
+	vlog = protowire.AppendString(vlog, "compiling\n")
+
+	var status []byte
+	status = protowire.AppendTag(status, statusVertexes, protowire.BytesType)
+	status = protowire.AppendBytes(status, vertex)
+	status = protowire.AppendTag(status, statusLogs, protowire.BytesType)
+	status = protowire.AppendBytes(status, vlog)
+
+	trace, _ := json.Marshal(map[string]interface{}{"id": auxBuildkitTrace, "aux": base64.StdEncoding.EncodeToString(status)})
+	stream := string(trace) + "\n" + `{"id":"moby.image.id","aux":{"ID":"sha256:1234"}}` + "\n"
+
+	var out bytes.Buffer
+	var imageId string
+	err := readDockerStream(strings.NewReader(stream), &out, func(id string, data json.RawMessage) {
+		var r struct{ ID string }
+		json.Unmarshal(data, &r)
+		imageId = r.ID
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageId != "sha256:1234" {
+		t.Fatalf("got image id %q", imageId)
+	}
+	if want := "#1 [2/2] RUN make\n#1 compiling\n"; out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
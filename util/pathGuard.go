@@ -0,0 +1,99 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrPathNotAllowed = errors.New("host path not allowed")
+
+// PathGuard restricts host paths written or bind-mounted by deploy tasks to a
+// set of allowed root directories.
+type PathGuard struct {
+	roots []string
+}
+
+func NewPathGuard(roots []string) (*PathGuard, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("at least one allowed host path is required")
+	}
+
+	g := &PathGuard{}
+	for _, r := range roots {
+		if !filepath.IsAbs(r) {
+			return nil, fmt.Errorf("allowed host path %q is not absolute", r)
+		}
+
+		resolved, err := resolveExisting(filepath.Clean(r))
+		if err != nil {
+			return nil, err
+		}
+		g.roots = append(g.roots, resolved)
+	}
+
+	return g, nil
+}
+
+// Resolve returns the canonical form of p with every symlink of its existing
+// part evaluated, or ErrPathNotAllowed when p is relative, contains ".." or
+// resolves outside the allowed roots.
+func (g *PathGuard) Resolve(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("%w: %s is not absolute", ErrPathNotAllowed, p)
+	}
+
+	for _, e := range strings.Split(filepath.ToSlash(p), "/") {
+		if e == ".." {
+			return "", fmt.Errorf("%w: %s contains ..", ErrPathNotAllowed, p)
+		}
+	}
+
+	resolved, err := resolveExisting(filepath.Clean(p))
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range g.roots {
+		if resolved == r || strings.HasPrefix(resolved, r+string(filepath.Separator)) || r == string(filepath.Separator) {
+			return resolved, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s is outside %s", ErrPathNotAllowed, p, strings.Join(g.roots, ", "))
+}
+
+// resolveExisting evaluates the symlinks of the longest existing ancestor of p
+// and appends the remaining, not yet created, elements, none of which may be a
+// symlink.
+func resolveExisting(p string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			for i := len(rest) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, rest[i])
+			}
+			return resolved, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// A dangling symlink would let a file created at p land wherever it
+		// points.
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: %s is a dangling symlink", ErrPathNotAllowed, p)
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append(rest, filepath.Base(p))
+		p = parent
+	}
+}
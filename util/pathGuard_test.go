@@ -0,0 +1,68 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathGuard(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "pwned"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewPathGuard([]string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := []string{
+		root,
+		filepath.Join(root, "swag/config"),
+		filepath.Join(root, "new/dir/file.conf"),
+	}
+	for _, p := range allowed {
+		if _, err := g.Resolve(p); err != nil {
+			t.Errorf("Resolve(%q) = %v, want allowed", p, err)
+		}
+	}
+
+	denied := []string{
+		"/etc/passwd",
+		"relative/path",
+		filepath.Join(root, "../etc"),
+		filepath.Join(root, "escape/file"),
+		filepath.Join(root, "dangling"),
+		filepath.Join(root, "dangling/file"),
+		root + "-sibling",
+	}
+	for _, p := range denied {
+		if _, err := g.Resolve(p); !errors.Is(err, ErrPathNotAllowed) {
+			t.Errorf("Resolve(%q) = %v, want ErrPathNotAllowed", p, err)
+		}
+	}
+}
+
+func TestWriteToFileNoFollow(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	link := filepath.Join(root, "link")
+	if err := os.Symlink(filepath.Join(outside, "pwned"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteToFile(link, "data"); err == nil {
+		t.Fatal("wrote through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("file created outside the root: %v", err)
+	}
+}
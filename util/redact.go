@@ -0,0 +1,123 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+const RedactedValue = "******"
+
+// DefaultRedactPatterns match the names of fields and variables that usually
+// hold credentials.
+var DefaultRedactPatterns = []string{`(?i)passw(or)?d`, `(?i)secret`, `(?i)token`, `(?i)api_?key`, `(?i)credential`, `(?i)private_?key`}
+
+// Redactor masks values whose key matches one of its patterns.
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+func NewRedactor(patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+// IsSecretKey reports whether a field or variable name looks like it holds a
+// secret.
+func (r *Redactor) IsSecretKey(key string) bool {
+	for _, p := range r.patterns {
+		if p.MatchString(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Env masks the values of KEY=VALUE entries whose key looks secret.
+func (r *Redactor) Env(env []string) []string {
+	if env == nil {
+		return nil
+	}
+
+	res := make([]string, len(env))
+	for i, e := range env {
+		k, _, ok := strings.Cut(e, "=")
+		if ok && r.IsSecretKey(k) {
+			e = k + "=" + RedactedValue
+		}
+		res[i] = e
+	}
+
+	return res
+}
+
+// Labels masks the values of labels whose key looks secret.
+func (r *Redactor) Labels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if r.IsSecretKey(k) {
+			v = RedactedValue
+		}
+		res[k] = v
+	}
+
+	return res
+}
+
+// Value returns a copy of a decoded JSON value with secret-looking object
+// fields masked and KEY=VALUE strings redacted as in Env.
+func (r *Redactor) Value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			if r.IsSecretKey(k) {
+				res[k] = RedactedValue
+			} else {
+				res[k] = r.Value(e)
+			}
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, e := range t {
+			res[i] = r.Value(e)
+		}
+		return res
+	case string:
+		return r.Env([]string{t})[0]
+	default:
+		return v
+	}
+}
+
+// ContainerJSON masks the secret environment variables and labels of an
+// inspected container.
+func (r *Redactor) ContainerJSON(c *types.ContainerJSON) {
+	if c.Config != nil {
+		cfg := *c.Config
+		cfg.Env = r.Env(cfg.Env)
+		cfg.Labels = r.Labels(cfg.Labels)
+		c.Config = &cfg
+	}
+}
+
+// Container masks the secret labels of a listed container.
+func (r *Redactor) Container(c *types.Container) {
+	c.Labels = r.Labels(c.Labels)
+}
@@ -0,0 +1,215 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"deploybot-service-agent/model"
+)
+
+const secretKeySize = 32
+
+var (
+	ErrSecretNotFound    = errors.New("secret not found")
+	ErrInvalidSecretName = errors.New("invalid secret name")
+
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	secretRefPattern  = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+)
+
+type sealedSecret struct {
+	Nonce     []byte    `json:"nonce"`
+	Value     []byte    `json:"value"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SecretStore keeps named secrets in a JSON file, each value sealed with
+// AES-256-GCM using the secret name as additional data.
+type SecretStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu      sync.RWMutex
+	secrets map[string]sealedSecret
+}
+
+func NewSecretStore(path string, key []byte) (*SecretStore, error) {
+	if len(key) != secretKeySize {
+		return nil, fmt.Errorf("secret key must be %d bytes, got %d", secretKeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SecretStore{path: path, aead: aead, secrets: map[string]sealedSecret{}}
+
+	bs, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(bs, &s.secrets)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// LoadOrCreateSecretKey decodes a base64 key, or reads the key file and
+// generates it when it does not exist yet.
+func LoadOrCreateSecretKey(encoded, file string) ([]byte, error) {
+	if encoded != "" {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+
+	bs, err := os.ReadFile(file)
+	if err == nil {
+		return base64.StdEncoding.DecodeString(string(bs))
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, secretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (s *SecretStore) Set(name, value string) error {
+	if !secretNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidSecretName, name)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.secrets[name]
+	s.secrets[name] = sealedSecret{Nonce: nonce, Value: s.aead.Seal(nil, nonce, []byte(value), []byte(name)), UpdatedAt: time.Now().UTC()}
+
+	if err := s.save(); err != nil {
+		if existed {
+			s.secrets[name] = prev
+		} else {
+			delete(s.secrets, name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *SecretStore) Get(name string) (string, error) {
+	s.mu.RLock()
+	sealed, ok := s.secrets[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+
+	value, err := s.aead.Open(nil, sealed.Nonce, sealed.Value, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", name, err)
+	}
+
+	return string(value), nil
+}
+
+func (s *SecretStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.secrets[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+
+	delete(s.secrets, name)
+
+	if err := s.save(); err != nil {
+		s.secrets[name] = prev
+		return err
+	}
+
+	return nil
+}
+
+// List returns the names and update times of the stored secrets, never their
+// values.
+func (s *SecretStore) List() []model.SecretInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]model.SecretInfo, 0, len(s.secrets))
+	for name, sealed := range s.secrets {
+		res = append(res, model.SecretInfo{Name: name, UpdatedAt: sealed.UpdatedAt})
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+// Expand replaces every ${secret:name} reference in text with the secret
+// value.
+func (s *SecretStore) Expand(text string) (string, error) {
+	var err error
+
+	res := secretRefPattern.ReplaceAllStringFunc(text, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+
+		var value string
+		value, err = s.Get(secretRefPattern.FindStringSubmatch(ref)[1])
+		return value
+	})
+
+	return res, err
+}
+
+func (s *SecretStore) save() error {
+	bs, err := json.Marshal(s.secrets)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(s.path, bs, 0600)
+}
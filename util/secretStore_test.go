@@ -0,0 +1,58 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretStore(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secrets.json")
+
+	key, err := LoadOrCreateSecretKey("", filepath.Join(dir, "secrets.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSecretStore(file, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set("pg_password", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set("../x", "v"); !errors.Is(err, ErrInvalidSecretName) {
+		t.Errorf("Set with invalid name: err = %v", err)
+	}
+
+	bs, _ := os.ReadFile(file)
+	if bytes.Contains(bs, []byte("hunter2")) {
+		t.Fatal("secret stored in plaintext")
+	}
+
+	reopened, err := NewSecretStore(file, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := reopened.Expand("postgres://app:${secret:pg_password}@db/app")
+	if err != nil || v != "postgres://app:hunter2@db/app" {
+		t.Errorf("Expand = %q, %v", v, err)
+	}
+
+	if _, err := reopened.Expand("${secret:missing}"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Expand missing: err = %v", err)
+	}
+
+	if err := reopened.Delete("pg_password"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.List()) != 0 {
+		t.Errorf("List after delete = %v", reopened.List())
+	}
+}
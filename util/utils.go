@@ -3,6 +3,7 @@ package util
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"deploybot-service-agent/model"
 	"fmt"
 	"io"
@@ -37,8 +38,9 @@ func WriteToFile(path string, content string) error {
 		return err
 	}
 
-	// Open the file with truncation flag to ensure it's overwritten
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// Open the file with truncation flag to ensure it's overwritten. path is
+	// resolved by PathGuard, so a symlink there was swapped in since.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
 	if err != nil {
 		return err
 	}
@@ -51,6 +53,41 @@ func WriteToFile(path string, content string) error {
 	return nil
 }
 
+// WriteFileAtomic replaces file with data by writing a temporary file in the
+// same directory and renaming it over the original.
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
 func CreateDirsIfNotExist(dirPath string) error {
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
 		err := os.MkdirAll(dirPath, os.ModePerm)
@@ -122,11 +159,11 @@ type GitCredentials struct {
 	Password string
 }
 
-func CloneRepo(path, cloneUrl, branch string, cred GitCredentials) error {
-	_, err := git.PlainClone(path, false, &git.CloneOptions{
+func CloneRepo(ctx context.Context, path, cloneUrl, branch string, cred GitCredentials, progress io.Writer) error {
+	_, err := git.PlainCloneContext(ctx, path, false, &git.CloneOptions{
 		URL:               cloneUrl,
 		ReferenceName:     plumbing.NewBranchReferenceName(branch),
-		Progress:          os.Stdout,
+		Progress:          progress,
 		RecurseSubmodules: 1,
 		Auth: &http.BasicAuth{
 			Username: cred.Username,